@@ -0,0 +1,248 @@
+/*
+ * Stop sending requests to an upstream that keeps failing, and try it again
+ * once in a while.
+ */
+
+package ptcp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota //requests go through
+	CircuitOpen                         //requests fail with ErrCircuitOpen
+	CircuitHalfOpen                     //a few trial requests go through
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const (
+	DefaultCircuitWindow      = 10 * time.Second
+	DefaultCircuitMinRequests = 10
+	DefaultCircuitErrorRate   = 0.5
+	DefaultCircuitOpenTimeout = 5 * time.Second
+)
+
+var ErrCircuitOpen = errors.New("Circuit breaker is open")
+
+/*
+ * CircuitBreaker is a ClientHandler that passes requests on to Handler while
+ * the upstream is well, and fails them at once with ErrCircuitOpen once it is
+ * not. The calls are counted over windows of Window: when at least MinRequests
+ * were made and the fraction that failed reaches ErrorRate, or the fraction that
+ * took SlowCall or longer reaches SlowRate, the circuit opens. After OpenTimeout
+ * it is half-open and lets HalfOpenRequests calls through: if they all succeed
+ * in time the circuit closes, and the first that does not opens it again.
+ *
+ * Use Call to also keep failing calls from dialing, e.g. around Pool.SendAndReceive.
+ */
+type CircuitBreaker struct {
+	Handler ClientHandler
+	//Window is the period calls are counted over; zero means DefaultCircuitWindow
+	Window time.Duration
+	//MinRequests is the fewest calls in a window that can open the circuit; zero means DefaultCircuitMinRequests
+	MinRequests int
+	//ErrorRate is the fraction of failed calls that opens the circuit; zero means DefaultCircuitErrorRate
+	ErrorRate float64
+	//SlowCall is the duration from which a call counts as slow; zero means latency is not considered
+	SlowCall time.Duration
+	//SlowRate is the fraction of slow calls that opens the circuit; zero means all of them
+	SlowRate float64
+	//OpenTimeout is how long the circuit stays open; zero means DefaultCircuitOpenTimeout
+	OpenTimeout time.Duration
+	//HalfOpenRequests is how many trial calls are let through; zero means one
+	HalfOpenRequests int
+	//OnStateChange is called after each change of state, e.g. to log it
+	OnStateChange func(from CircuitState, to CircuitState)
+
+	mutex       sync.Mutex
+	state       CircuitState
+	generation  uint64 //changes with the state; tells the calls let through in one state from the others
+	windowStart time.Time
+	calls       int //in the window
+	failures    int
+	slow        int
+	openedAt    time.Time
+	trials      int //let through while half-open
+	passed      int //trials that succeeded
+}
+
+func NewCircuitBreaker(handler ClientHandler) *CircuitBreaker {
+	return &CircuitBreaker{Handler: handler}
+}
+
+//State returns the current state; an open circuit past OpenTimeout is reported half-open
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.openTimeout() {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+func (cb *CircuitBreaker) window() time.Duration {
+	if cb.Window > 0 {
+		return cb.Window
+	}
+	return DefaultCircuitWindow
+}
+
+func (cb *CircuitBreaker) minRequests() int {
+	if cb.MinRequests > 0 {
+		return cb.MinRequests
+	}
+	return DefaultCircuitMinRequests
+}
+
+func (cb *CircuitBreaker) errorRate() float64 {
+	if cb.ErrorRate > 0 {
+		return cb.ErrorRate
+	}
+	return DefaultCircuitErrorRate
+}
+
+func (cb *CircuitBreaker) slowRate() float64 {
+	if cb.SlowRate > 0 {
+		return cb.SlowRate
+	}
+	return 1
+}
+
+func (cb *CircuitBreaker) openTimeout() time.Duration {
+	if cb.OpenTimeout > 0 {
+		return cb.OpenTimeout
+	}
+	return DefaultCircuitOpenTimeout
+}
+
+func (cb *CircuitBreaker) halfOpenRequests() int {
+	if cb.HalfOpenRequests > 0 {
+		return cb.HalfOpenRequests
+	}
+	return 1
+}
+
+//must hold the mutex
+func (cb *CircuitBreaker) setState(state CircuitState, now time.Time) {
+	cb.state = state
+	cb.generation++
+	cb.windowStart = now
+	cb.calls, cb.failures, cb.slow = 0, 0, 0
+	cb.trials, cb.passed = 0, 0
+	if state == CircuitOpen {
+		cb.openedAt = now
+	}
+}
+
+func (cb *CircuitBreaker) notify(from CircuitState, to CircuitState) {
+	if from != to && cb.OnStateChange != nil {
+		cb.OnStateChange(from, to)
+	}
+}
+
+//allow decides whether a call may go through, and returns the generation of the state that let it
+func (cb *CircuitBreaker) allow() (uint64, error) {
+	cb.mutex.Lock()
+	now := time.Now()
+	from := cb.state
+	switch cb.state {
+	case CircuitOpen:
+		if now.Sub(cb.openedAt) < cb.openTimeout() {
+			cb.mutex.Unlock()
+			return 0, ErrCircuitOpen
+		}
+		cb.setState(CircuitHalfOpen, now)
+		fallthrough
+	case CircuitHalfOpen:
+		//setState has just reset trials if the circuit was open
+		if cb.trials >= cb.halfOpenRequests() {
+			cb.mutex.Unlock()
+			return 0, ErrCircuitOpen
+		}
+		cb.trials++
+	}
+	to, generation := cb.state, cb.generation
+	cb.mutex.Unlock()
+	cb.notify(from, to)
+	return generation, nil
+}
+
+//record counts the outcome of a call that allow let through in generation
+func (cb *CircuitBreaker) record(generation uint64, failed bool, took time.Duration) {
+	slow := cb.SlowCall > 0 && took >= cb.SlowCall
+	cb.mutex.Lock()
+	if generation != cb.generation {
+		//let through before the last change of state, e.g. while closed and now
+		//ending while half-open: it is not one of the trials
+		cb.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	from := cb.state
+	switch cb.state {
+	case CircuitHalfOpen:
+		if failed || slow {
+			cb.setState(CircuitOpen, now)
+		} else if cb.passed++; cb.passed >= cb.halfOpenRequests() {
+			cb.setState(CircuitClosed, now)
+		}
+	case CircuitClosed:
+		if now.Sub(cb.windowStart) >= cb.window() {
+			cb.windowStart = now
+			cb.calls, cb.failures, cb.slow = 0, 0, 0
+		}
+		cb.calls++
+		if failed {
+			cb.failures++
+		}
+		if slow {
+			cb.slow++
+		}
+		if cb.calls >= cb.minRequests() &&
+			(float64(cb.failures) >= cb.errorRate()*float64(cb.calls) ||
+				cb.SlowCall > 0 && float64(cb.slow) >= cb.slowRate()*float64(cb.calls)) {
+			cb.setState(CircuitOpen, now)
+		}
+	}
+	to := cb.state
+	cb.mutex.Unlock()
+	cb.notify(from, to)
+}
+
+//Call runs fn if the circuit lets it through, and counts the outcome
+func (cb *CircuitBreaker) Call(fn func() (Response, error)) (Response, error) {
+	generation, err := cb.allow()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	response, err := fn()
+	cb.record(generation, err != nil, time.Since(start))
+	return response, err
+}
+
+func (cb *CircuitBreaker) Handle(connection *TcpConnection, request Request) (Response, error) {
+	if cb.Handler == nil {
+		return nil, ErrorMissingClientHandler
+	}
+	return cb.Call(func() (Response, error) {
+		return cb.Handler.Handle(connection, request)
+	})
+}
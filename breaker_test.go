@@ -0,0 +1,150 @@
+package ptcp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//StubClientHandler answers without using the connection, failing while fail is set
+type StubClientHandler struct {
+	fail  bool
+	delay time.Duration
+	calls int
+}
+
+func (h *StubClientHandler) Handle(connection *TcpConnection, request Request) (Response, error) {
+	h.calls++
+	time.Sleep(h.delay)
+	if h.fail {
+		return nil, errors.New("upstream failed")
+	}
+	data := DataStream(DefaultResponse)
+	return &data, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	stub := &StubClientHandler{}
+	cb := NewCircuitBreaker(stub)
+	cb.MinRequests = 4
+	cb.OpenTimeout = 50 * time.Millisecond
+	var changes []string
+	cb.OnStateChange = func(from CircuitState, to CircuitState) {
+		changes = append(changes, from.String()+"->"+to.String())
+	}
+	data := DataStream("")
+
+	//one failure in four is below the error rate
+	for i := 0; i < 4; i++ {
+		stub.fail = i == 0
+		cb.Handle(nil, &data)
+	}
+	if state := cb.State(); state != CircuitClosed {
+		t.Fatalf("circuit is %s after 25%% errors, expected closed", state)
+	}
+	stub.fail = true
+	for i := 0; i < 4; i++ {
+		cb.Handle(nil, &data)
+	}
+	if state := cb.State(); state != CircuitOpen {
+		t.Fatalf("circuit is %s after 75%% errors, expected open", state)
+	}
+	calls := stub.calls
+	if _, err := cb.Handle(nil, &data); err != ErrCircuitOpen {
+		t.Errorf("open circuit returned %v, expected %v", err, ErrCircuitOpen)
+	}
+	if stub.calls != calls {
+		t.Errorf("open circuit called the handler")
+	}
+
+	//the trial request fails, so the circuit opens again
+	time.Sleep(cb.OpenTimeout)
+	if state := cb.State(); state != CircuitHalfOpen {
+		t.Errorf("circuit is %s after the open timeout, expected half-open", state)
+	}
+	cb.Handle(nil, &data)
+	if state := cb.State(); state != CircuitOpen {
+		t.Errorf("circuit is %s after a failed trial, expected open", state)
+	}
+
+	time.Sleep(cb.OpenTimeout)
+	stub.fail = false
+	if response, err := cb.Handle(nil, &data); err != nil || responseString(response) != DefaultResponse {
+		t.Errorf("trial request got %q, %v", responseString(response), err)
+	}
+	if state := cb.State(); state != CircuitClosed {
+		t.Errorf("circuit is %s after a successful trial, expected closed", state)
+	}
+
+	expected := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if len(changes) != len(expected) {
+		t.Fatalf("state changes %v, expected %v", changes, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("state changes %v, expected %v", changes, expected)
+			break
+		}
+	}
+}
+
+func TestCircuitBreakerSlowCalls(t *testing.T) {
+	stub := &StubClientHandler{delay: 10 * time.Millisecond}
+	cb := NewCircuitBreaker(stub)
+	cb.MinRequests = 2
+	cb.SlowCall = 5 * time.Millisecond
+	data := DataStream("")
+	for i := 0; i < 2; i++ {
+		if _, err := cb.Handle(nil, &data); err != nil {
+			t.Fatalf("slow request failed: %v", err)
+		}
+	}
+	if _, err := cb.Handle(nil, &data); err != ErrCircuitOpen {
+		t.Errorf("got %v after slow calls, expected %v", err, ErrCircuitOpen)
+	}
+}
+
+func TestCircuitBreakerStaleCall(t *testing.T) {
+	cb := NewCircuitBreaker(nil)
+	cb.MinRequests = 1
+	cb.OpenTimeout = 20 * time.Millisecond
+	//a call that blocks until released, and reports when it has ended
+	slowCall := func(release chan bool) (started chan bool, done chan error) {
+		started, done = make(chan bool), make(chan error, 1)
+		go func() {
+			_, err := cb.Call(func() (Response, error) {
+				close(started)
+				<-release
+				return nil, nil
+			})
+			done <- err
+		}()
+		return
+	}
+
+	release := make(chan bool)
+	started, done := slowCall(release)
+	<-started
+	cb.Call(func() (Response, error) { return nil, errors.New("upstream failed") })
+	if state := cb.State(); state != CircuitOpen {
+		t.Fatalf("circuit is %s after a failure, expected open", state)
+	}
+
+	time.Sleep(cb.OpenTimeout)
+	trialRelease := make(chan bool)
+	trialStarted, trialDone := slowCall(trialRelease)
+	<-trialStarted
+	//the call let through while closed ends while the trial is running
+	close(release)
+	<-done
+	if state := cb.State(); state != CircuitHalfOpen {
+		t.Errorf("circuit is %s after a call from before it opened, expected half-open", state)
+	}
+	close(trialRelease)
+	if err := <-trialDone; err != nil {
+		t.Errorf("trial returned %v", err)
+	}
+	if state := cb.State(); state != CircuitClosed {
+		t.Errorf("circuit is %s after a successful trial, expected closed", state)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Bounded capture of the data read from a connection.
+ */
+
+package ptcp
+
+import "errors"
+
+//ErrorCaptureOverflow is returned by handlers that need all of a message larger than the capture limit
+var ErrorCaptureOverflow = errors.New("Message larger than the capture limit")
+
+//CapturePolicy decides what is kept of a message larger than the capture limit
+type CapturePolicy int
+
+const (
+	CaptureDiscard CapturePolicy = iota //keep nothing of the message, RawData returns nil
+	CaptureHead                         //keep the first Bytes of the message
+	CaptureTail                         //keep the last Bytes of the message
+)
+
+//CaptureLimit bounds the data a connection captures per message, see EnableSaveReadData.
+//The zero value captures without limit.
+type CaptureLimit struct {
+	Bytes  int
+	Policy CapturePolicy
+}
+
+/*
+ * capture holds the data of the current message. total counts all of it,
+ * including what the policy did not keep; the last bytes of it may have been
+ * read ahead and not consumed yet, and are not part of the message so far.
+ */
+type capture struct {
+	limit CaptureLimit
+	data  []byte
+	total int64
+}
+
+//a new capture allocates nothing: one is started for every message, and most are small
+func newCapture(limit CaptureLimit) *capture {
+	return &capture{limit: limit}
+}
+
+//how much of the stream a rolling window keeps: the window itself and what may be read ahead of it
+func (c *capture) window() int {
+	return c.limit.Bytes + ReadBufferLength
+}
+
+func (c *capture) write(data []byte) {
+	c.total += int64(len(data))
+	switch {
+	case c.limit.Bytes <= 0:
+		c.data = append(c.data, data...)
+	case c.limit.Policy == CaptureTail:
+		c.data = append(c.data, data...)
+		//move the window down only once the slack is used up
+		if window := c.window(); len(c.data) > 2*window {
+			c.data = append(c.data[:0], c.data[len(c.data)-window:]...)
+		}
+	default:
+		if room := c.limit.Bytes - len(c.data); room > 0 {
+			if len(data) > room {
+				data = data[:room]
+			}
+			c.data = append(c.data, data...)
+		}
+	}
+}
+
+//bytes of the message consumed, given how many have been read ahead
+func (c *capture) consumed(ahead int) int64 {
+	if int64(ahead) > c.total {
+		return 0
+	}
+	return c.total - int64(ahead)
+}
+
+func (c *capture) overflowed(ahead int) bool {
+	return c.limit.Bytes > 0 && c.consumed(ahead) > int64(c.limit.Bytes)
+}
+
+//the consumed part of the message that the policy kept
+func (c *capture) bytes(ahead int) []byte {
+	consumed := c.consumed(ahead)
+	switch {
+	case c.limit.Bytes <= 0:
+		return c.data[:consumed]
+	case c.limit.Policy == CaptureTail:
+		//data holds the end of the stream
+		end := int64(len(c.data)) - (c.total - consumed)
+		if end <= 0 {
+			return c.data[:0]
+		}
+		begin := end - int64(c.limit.Bytes)
+		if begin < 0 {
+			begin = 0
+		}
+		return c.data[begin:end]
+	case c.overflowed(ahead) && c.limit.Policy == CaptureDiscard:
+		return nil
+	}
+	if consumed > int64(len(c.data)) {
+		consumed = int64(len(c.data))
+	}
+	return c.data[:consumed]
+}
+
+//reset drops the message captured so far
+func (c *capture) reset() {
+	c.data = c.data[:0]
+	c.total = 0
+}
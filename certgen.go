@@ -0,0 +1,169 @@
+/*
+ * Generate certificates in memory so that TLS can be used in tests and on
+ * development servers without key files.
+ */
+
+package ptcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+//TestCertificateLifetime is how long generated certificates are valid
+const TestCertificateLifetime = 24 * time.Hour
+
+// TestCA is a certificate authority kept in memory. It issues certificates
+// that are valid for both servers and clients. It is not meant for production.
+type TestCA struct {
+	Certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func NewTestCA() (*TestCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ptcp test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(TestCertificateLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &TestCA{Certificate: cert, key: key}, nil
+}
+
+//Issue creates a certificate for the given host names and IP addresses;
+//the first one is also the common name
+func (ca *TestCA) Issue(hosts ...string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(TestCertificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+//CertPool returns a pool that trusts the CA
+func (ca *TestCA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+//ServerTLSConfig returns a server config with a certificate for hosts that also
+//trusts client certificates issued by the CA, see SetClientAuth
+func (ca *TestCA) ServerTLSConfig(hosts ...string) (*tls.Config, error) {
+	cert, err := ca.Issue(hosts...)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientCAs:    ca.CertPool(),
+		NextProtos:   []string{"http/1.1"},
+	}, nil
+}
+
+//ClientTLSConfig returns a client config that trusts the CA and presents a
+//certificate issued to the given names when asked for one
+func (ca *TestCA) ClientTLSConfig(names ...string) (*tls.Config, error) {
+	cert, err := ca.Issue(names...)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      ca.CertPool(),
+	}, nil
+}
+
+//WriteKeyPair saves cert and its key in the PEM files tls.LoadX509KeyPair reads
+func WriteKeyPair(cert *tls.Certificate, certFile string, keyFile string) error {
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, keyPEM, 0600)
+}
+
+//GenerateTestTLS creates a new CA and returns matching server and client configs
+//for the given host names and IP addresses
+func GenerateTestTLS(hosts ...string) (serverConfig *tls.Config, clientConfig *tls.Config, err error) {
+	ca, err := NewTestCA()
+	if err != nil {
+		return
+	}
+	if serverConfig, err = ca.ServerTLSConfig(hosts...); err != nil {
+		return
+	}
+	clientConfig, err = ca.ClientTLSConfig("ptcp test client")
+	return
+}
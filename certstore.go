@@ -0,0 +1,272 @@
+/*
+ * Serve many host names from one TLS listener.
+ */
+
+package ptcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrorNoServerCertificate = errors.New("No certificate for the requested server name")
+
+//DefaultCertificateName is the base name of the certificate pair used for clients
+//that send no or an unknown server name, see LoadDir
+const DefaultCertificateName = "default"
+
+// CertificateStore picks the server certificate for each TLS handshake by the
+// SNI server name the client asked for. Use TLSConfig, or set GetCertificate
+// on a tls.Config. The certificates can be swapped while the server is running.
+type CertificateStore struct {
+	mutex    sync.RWMutex
+	certs    map[string]*tls.Certificate //keyed by lower case host name; wildcards as "*.example.com"
+	fallback *tls.Certificate
+	dir      string
+	modTimes map[string]time.Time //of the files last loaded from dir
+}
+
+func NewCertificateStore() *CertificateStore {
+	return &CertificateStore{certs: make(map[string]*tls.Certificate)}
+}
+
+//names a certificate is valid for
+func certificateNames(cert *tls.Certificate) ([]string, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf = leaf
+	}
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	return names, nil
+}
+
+func addCertificate(certs map[string]*tls.Certificate, cert *tls.Certificate) error {
+	names, err := certificateNames(cert)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		certs[strings.ToLower(name)] = cert
+	}
+	return nil
+}
+
+//Add makes cert available for every DNS name it is valid for, including wildcards.
+//The first certificate added also becomes the default.
+func (store *CertificateStore) Add(cert *tls.Certificate) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := addCertificate(store.certs, cert); err != nil {
+		return err
+	}
+	if store.fallback == nil {
+		store.fallback = cert
+	}
+	return nil
+}
+
+//SetDefault sets the certificate for clients that send no or an unknown server name
+func (store *CertificateStore) SetDefault(cert *tls.Certificate) {
+	store.mutex.Lock()
+	store.fallback = cert
+	store.mutex.Unlock()
+}
+
+//GetCertificate matches the server name exactly, then against a wildcard one level up,
+//and falls back on the default certificate
+func (store *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if cert, ok := store.certs[name]; ok {
+		return cert, nil
+	}
+	if dot := strings.Index(name, "."); dot > 0 {
+		if cert, ok := store.certs["*"+name[dot:]]; ok {
+			return cert, nil
+		}
+	}
+	if store.fallback != nil {
+		return store.fallback, nil
+	}
+	return nil, ErrorNoServerCertificate
+}
+
+//TLSConfig returns a server config that takes its certificates from the store
+func (store *CertificateStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: store.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+}
+
+//list the certificate pairs in dir and the modification times of their files
+func scanCertificateDir(dir string) (pairs []string, modTimes map[string]time.Time, err error) {
+	certFiles, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return
+	}
+	sort.Strings(certFiles)
+	modTimes = make(map[string]time.Time)
+	for _, certFile := range certFiles {
+		base := strings.TrimSuffix(certFile, ".crt")
+		keyFile := base + ".key"
+		for _, file := range []string{certFile, keyFile} {
+			info, statErr := os.Stat(file)
+			if statErr != nil {
+				return nil, nil, statErr
+			}
+			modTimes[file] = info.ModTime()
+		}
+		pairs = append(pairs, base)
+	}
+	return
+}
+
+/*
+ * LoadDir replaces the certificates in the store with the pairs in dir: each
+ * name.crt (PEM, may include the chain) with its name.key. The pair named
+ * DefaultCertificateName is the default, otherwise the first pair by name.
+ * Nothing is changed if any pair fails to load.
+ */
+func (store *CertificateStore) LoadDir(dir string) error {
+	pairs, modTimes, err := scanCertificateDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return ErrorNoCertificates
+	}
+
+	certs := make(map[string]*tls.Certificate)
+	var fallback *tls.Certificate
+	for _, base := range pairs {
+		cert, err := tls.LoadX509KeyPair(base+".crt", base+".key")
+		if err != nil {
+			return err
+		}
+		if err = addCertificate(certs, &cert); err != nil {
+			return err
+		}
+		if fallback == nil || filepath.Base(base) == DefaultCertificateName {
+			fallback = &cert
+		}
+	}
+
+	store.mutex.Lock()
+	store.certs = certs
+	store.fallback = fallback
+	store.dir = dir
+	store.modTimes = modTimes
+	store.mutex.Unlock()
+	return nil
+}
+
+func LoadCertificateDir(dir string) (*CertificateStore, error) {
+	store := NewCertificateStore()
+	if err := store.LoadDir(dir); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+//Reload loads the directory given to LoadDir again
+func (store *CertificateStore) Reload() error {
+	store.mutex.RLock()
+	dir := store.dir
+	store.mutex.RUnlock()
+	if dir == "" {
+		return nil
+	}
+	return store.LoadDir(dir)
+}
+
+//whether the files in the directory have changed since they were loaded
+func (store *CertificateStore) changed() bool {
+	store.mutex.RLock()
+	dir, loaded := store.dir, store.modTimes
+	store.mutex.RUnlock()
+	_, modTimes, err := scanCertificateDir(dir)
+	if err != nil {
+		//a pair is being replaced; look again next time
+		return false
+	}
+	if len(modTimes) != len(loaded) {
+		return true
+	}
+	for file, modTime := range modTimes {
+		if !loaded[file].Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Watch reloads the directory on SIGHUP and, if interval is positive, whenever
+ * the files in it change. Connections in progress keep the certificate they
+ * were accepted with. Failures are logged and the old certificates stay in use.
+ * Call the returned function to stop watching; it returns once a reload in
+ * progress is over, and none happens after it.
+ */
+func (store *CertificateStore) Watch(interval time.Duration, logger *golog.Logger) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+
+	quit := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer signal.Stop(hup)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-hup:
+			case <-tick:
+				if !store.changed() {
+					continue
+				}
+			case <-quit:
+				return
+			}
+			if err := store.Reload(); err != nil {
+				logger.Error("Failed to reload certificates: %v", err)
+			} else {
+				logger.Info("Reloaded certificates")
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+		<-done
+	}
+}
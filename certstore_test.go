@@ -0,0 +1,170 @@
+package ptcp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func fakeCertificate(commonName string, dnsNames ...string) *tls.Certificate {
+	return &tls.Certificate{Leaf: &x509.Certificate{Subject: pkix.Name{CommonName: commonName}, DNSNames: dnsNames}}
+}
+
+func TestCertificateStoreGetCertificate(t *testing.T) {
+	store := NewCertificateStore()
+	first := fakeCertificate("first", "www.example.com", "example.com")
+	wildcard := fakeCertificate("wildcard", "*.example.org")
+	fallback := fakeCertificate("fallback.example.net")
+	for _, cert := range []*tls.Certificate{first, wildcard} {
+		if err := store.Add(cert); err != nil {
+			t.Fatalf("failed to add certificate: %v", err)
+		}
+	}
+
+	cases := []struct {
+		serverName string
+		expected   *tls.Certificate
+	}{
+		{"www.example.com", first},
+		{"EXAMPLE.com.", first},
+		{"api.example.org", wildcard},
+		{"a.b.example.org", first}, //wildcards only cover one label
+		{"example.org", first},
+		{"", first},
+	}
+	for _, c := range cases {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: c.serverName})
+		if err != nil || cert != c.expected {
+			t.Errorf("%q: got %v, %v; expected %v", c.serverName, cert.Leaf.Subject.CommonName, err, c.expected.Leaf.Subject.CommonName)
+		}
+	}
+
+	store.SetDefault(fallback)
+	if cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.host"}); cert != fallback {
+		t.Errorf("unknown server name did not get the default certificate")
+	}
+}
+
+func TestCertificateStoreLoadDir(t *testing.T) {
+	ca, err := NewTestCA()
+	if err != nil {
+		t.Fatalf("failed to create the CA: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "ptcp-certs")
+	if err != nil {
+		t.Fatalf("failed to create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writePair := func(name string, hosts ...string) {
+		cert, err := ca.Issue(hosts...)
+		if err != nil {
+			t.Fatalf("failed to issue a certificate: %v", err)
+		}
+		base := filepath.Join(dir, name)
+		if err = WriteKeyPair(cert, base+".crt", base+".key"); err != nil {
+			t.Fatalf("failed to write a certificate: %v", err)
+		}
+	}
+	writePair("a", "a.example.com")
+	writePair("wildcard", "*.example.org")
+	writePair(DefaultCertificateName, "default.example.net")
+
+	store, err := LoadCertificateDir(dir)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", dir, err)
+	}
+	srv := NewServer(&EchoServerHandler{})
+	if err = srv.StartTLSConfig(TestAddr3, store.TLSConfig()); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer srv.Close()
+
+	expectServedName := func(serverName string, expected string) {
+		config := &tls.Config{RootCAs: ca.CertPool(), ServerName: serverName, InsecureSkipVerify: serverName == ""}
+		_, connection, err := exchangeTLS(TestAddr3, config)
+		if err != nil {
+			t.Errorf("%q: %v", serverName, err)
+			return
+		}
+		if name := connection.PeerIdentity().Subject.CommonName; name != expected {
+			t.Errorf("%q: served the certificate of %q, expected %q", serverName, name, expected)
+		}
+	}
+	expectServedName("a.example.com", "a.example.com")
+	expectServedName("www.example.org", "*.example.org")
+	expectServedName("", "default.example.net")
+
+	//replace a pair and reload without restarting the listener
+	writePair("a", "a.example.com", "b.example.com")
+	if err = store.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	expectServedName("b.example.com", "a.example.com")
+}
+
+func TestCertificateStoreWatch(t *testing.T) {
+	ca, err := NewTestCA()
+	if err != nil {
+		t.Fatalf("failed to create the CA: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "ptcp-certs")
+	if err != nil {
+		t.Fatalf("failed to create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "a")
+	//write a new pair for a.example.com and return its certificate
+	writePair := func(modTime time.Time) []byte {
+		cert, err := ca.Issue("a.example.com")
+		if err != nil {
+			t.Fatalf("failed to issue a certificate: %v", err)
+		}
+		if err = WriteKeyPair(cert, base+".crt", base+".key"); err != nil {
+			t.Fatalf("failed to write a certificate: %v", err)
+		}
+		//make the change visible however coarse the file times are
+		os.Chtimes(base+".crt", modTime, modTime)
+		os.Chtimes(base+".key", modTime, modTime)
+		return cert.Certificate[0]
+	}
+	writePair(time.Now())
+	store, err := LoadCertificateDir(dir)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", dir, err)
+	}
+	expectServed := func(how string, expected []byte) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+			if err == nil && bytes.Equal(cert.Certificate[0], expected) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the certificate was not reloaded on %s", how)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	stop := store.Watch(10*time.Millisecond, newTestLogger())
+	expectServed("a change", writePair(time.Now().Add(time.Hour)))
+	stop()
+
+	//without polling only SIGHUP reloads
+	stop = store.Watch(0, newTestLogger())
+	defer stop()
+	replaced := writePair(time.Now().Add(2 * time.Hour))
+	time.Sleep(50 * time.Millisecond)
+	if cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"}); bytes.Equal(cert.Certificate[0], replaced) {
+		t.Fatalf("the certificate was reloaded without SIGHUP")
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	expectServed("SIGHUP", replaced)
+}
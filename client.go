@@ -13,13 +13,74 @@
 package ptcp
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 var ErrorMissingClientHandler = errors.New("Client missing a handler")
 
+//TLSHandshakeError is returned when the TLS handshake with a server fails
+type TLSHandshakeError struct {
+	Addr string
+	Err  error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return "TLS handshake with " + e.Addr + " failed: " + e.Err.Error()
+}
+
+func (e *TLSHandshakeError) Unwrap() error {
+	return e.Err
+}
+
+//TLSVerificationError is returned when a server's certificate can not be verified
+type TLSVerificationError struct {
+	Addr string
+	Err  error
+}
+
+func (e *TLSVerificationError) Error() string {
+	return "TLS certificate of " + e.Addr + " can not be verified: " + e.Err.Error()
+}
+
+func (e *TLSVerificationError) Unwrap() error {
+	return e.Err
+}
+
+//classify a handshake error as a verification or a handshake failure
+func newTLSError(addr string, err error) error {
+	var verifyErr *tls.CertificateVerificationError
+	var hostErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &verifyErr) || errors.As(err, &hostErr) || errors.As(err, &authorityErr) || errors.As(err, &invalidErr) {
+		return &TLSVerificationError{Addr: addr, Err: err}
+	}
+	return &TLSHandshakeError{Addr: addr, Err: err}
+}
+
+//use the host part of addr for SNI unless the config names a server
+func withServerName(config *tls.Config, addr string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName != "" {
+		return config
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
 type Request interface {
 	Bytes() []byte
 }
@@ -28,43 +89,115 @@ type Response interface {
 	Bytes() []byte
 }
 
-func Connect(addr string) (connection *TcpConnection, err error) {
-	if addr == "" {
-		addr = ":http"
+//DialFunc opens the raw connection to addr, e.g. through a proxy
+type DialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+//DialOptions configure ConnectContext. The zero value dials a plain connection without timeouts.
+type DialOptions struct {
+	DialTimeout         time.Duration
+	TLSConfig           *tls.Config //connect over TLS if not nil, see ConnectTLSConfig
+	TLSHandshakeTimeout time.Duration
+	LocalAddr           net.Addr      //local address to bind to, if not nil
+	KeepAlive           time.Duration //TCP keep-alive period; zero means the default, negative disables it
+	Dialer              DialFunc      //replaces the plain TCP dialer if not nil; LocalAddr and KeepAlive are then up to it
+}
+
+/*
+ * ConnectContext connects to addr, giving up when ctx is done or a timeout in
+ * opts expires. With opts.TLSConfig set it behaves like ConnectTLSConfig and
+ * reports handshake failures the same way.
+ */
+func ConnectContext(ctx context.Context, addr string, opts *DialOptions) (connection *TcpConnection, err error) {
+	if opts == nil {
+		opts = &DialOptions{}
 	}
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return
+	if addr == "" {
+		if opts.TLSConfig != nil {
+			addr = ":https"
+		} else {
+			addr = ":http"
+		}
 	}
-	connection, err = NewTcpConnection(conn)
-	return
-}
 
-func ConnectTLS(addr string, hostName string, shouldVerifyHost bool) (connection *TcpConnection, err error) {
-	conn, err := net.Dial("tcp", addr)
+	dialCtx := ctx
+	if opts.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, opts.DialTimeout)
+		defer cancel()
+	}
+	dial := opts.Dialer
+	if dial == nil {
+		dialer := &net.Dialer{LocalAddr: opts.LocalAddr, KeepAlive: opts.KeepAlive}
+		dial = dialer.DialContext
+	}
+	dialStart := time.Now()
+	conn, err := dial(dialCtx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	connectTime := time.Since(dialStart)
 
-	// Initiate TLS and check remote host name against certificate.
-	tlsConn := tls.Client(conn, nil)
+	if opts.TLSConfig == nil {
+		connection, err = NewTcpConnection(conn)
+		if err == nil {
+			connection.liveStats().dialed(dialStart, connectTime, 0)
+		}
+		return
+	}
 
-	connection, err = NewTcpConnection(tlsConn)
+	tlsConn := tls.Client(conn, withServerName(opts.TLSConfig, addr))
+	handshakeCtx := ctx
+	if opts.TLSHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = context.WithTimeout(ctx, opts.TLSHandshakeTimeout)
+		defer cancel()
+	}
+	handshakeStart := time.Now()
+	if err = tlsConn.HandshakeContext(handshakeCtx); err == nil {
+		handshake := time.Since(handshakeStart)
+		connection, err = NewTcpConnection(tlsConn)
+		if err == nil {
+			connection.liveStats().dialed(dialStart, connectTime, handshake)
+		}
+	}
 	if err != nil {
 		tlsConn.Close()
-	} else if shouldVerifyHost {
-		if err = tlsConn.VerifyHostname(hostName); err != nil {
-			tlsConn.Close()
-			return
-		}
+		return nil, newTLSError(addr, err)
 	}
 	return
 }
 
+func Connect(addr string) (connection *TcpConnection, err error) {
+	return ConnectContext(context.Background(), addr, nil)
+}
+
+//ConnectTLS connects to addr over TLS; if shouldVerifyHost is true the server's
+//certificate must be valid for hostName. Sessions are resumed with DefaultClientSessionCache.
+func ConnectTLS(addr string, hostName string, shouldVerifyHost bool) (connection *TcpConnection, err error) {
+	config := &tls.Config{
+		ServerName:         hostName,
+		InsecureSkipVerify: !shouldVerifyHost,
+		ClientSessionCache: DefaultClientSessionCache,
+	}
+	return ConnectTLSConfig(addr, config)
+}
+
+//ConnectTLSConfig connects to addr over TLS with the given config, see ClientTLSConfig.
+//If config.ServerName is empty, the host part of addr is used for SNI and verification.
+//A failed handshake is reported as a *TLSHandshakeError, or as a *TLSVerificationError
+//if the server's certificate was rejected.
+func ConnectTLSConfig(addr string, config *tls.Config) (connection *TcpConnection, err error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	return ConnectContext(context.Background(), addr, &DialOptions{TLSConfig: config})
+}
+
 func SendAndReceive(connection *TcpConnection, handler ClientHandler, request Request) (Response, error) {
 	if handler == nil {
 		return nil, ErrorMissingClientHandler
 	}
+	atomic.AddInt64(&connection.liveStats().requests, 1)
 	return handler.Handle(connection, request)
 }
 
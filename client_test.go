@@ -0,0 +1,102 @@
+package ptcp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	//the test certificate is not signed by a known authority
+	_, err := ConnectTLSConfig(addr, nil)
+	if _, ok := err.(*TLSVerificationError); !ok {
+		t.Errorf("connecting without the test CA returned %v, expected a TLSVerificationError", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	connection, err := ConnectTLSConfig(addr, &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("connecting with the test CA failed: %v", err)
+	}
+	connection.Close()
+
+	_, err = ConnectTLSConfig(addr, &tls.Config{RootCAs: pool, ServerName: "wrong.host"})
+	if _, ok := err.(*TLSVerificationError); !ok {
+		t.Errorf("connecting with the wrong server name returned %v, expected a TLSVerificationError", err)
+	}
+}
+
+func TestConnectTLSHandshakeError(t *testing.T) {
+	//a server that hangs up instead of doing the handshake
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, err = ConnectTLS(listener.Addr().String(), "localhost", false)
+	if _, ok := err.(*TLSHandshakeError); !ok {
+		t.Errorf("connecting to a non-TLS server returned %v, expected a TLSHandshakeError", err)
+	}
+}
+
+func TestConnectContextTimeouts(t *testing.T) {
+	//a dialer that never connects
+	blockingDialer := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	start := time.Now()
+	_, err := ConnectContext(context.Background(), "upstream:80", &DialOptions{DialTimeout: 50 * time.Millisecond, Dialer: blockingDialer})
+	if err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Errorf("dial returned %v after %v, expected a quick %v", err, time.Since(start), context.DeadlineExceeded)
+	}
+
+	//a server that accepts but never answers the handshake
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	start = time.Now()
+	opts := &DialOptions{TLSConfig: &tls.Config{InsecureSkipVerify: true}, TLSHandshakeTimeout: 50 * time.Millisecond}
+	_, err = ConnectContext(context.Background(), listener.Addr().String(), opts)
+	if _, ok := err.(*TLSHandshakeError); !ok || time.Since(start) > time.Second {
+		t.Errorf("handshake returned %v after %v, expected a quick TLSHandshakeError", err, time.Since(start))
+	}
+
+	//the context cancels the whole attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = ConnectContext(ctx, listener.Addr().String(), nil); err == nil {
+		t.Errorf("connecting with a cancelled context succeeded")
+	}
+}
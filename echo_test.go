@@ -17,6 +17,7 @@ const DefaultResponse = "World"
 const HandlerLimit = 8
 
 const TestAddr = "localhost:13252"
+const TestAddr4 = "localhost:13255"
 
 type DataStream string
 
@@ -116,9 +117,9 @@ func (ech *EchoClientHandler) Handle(connection *TcpConnection, request Request)
 func TestEcho(t *testing.T) {
 	address := TestAddr
 	wg := &sync.WaitGroup{}
-	clientHandler := NewEchoClientHandler()
 	serverHandler := &EchoServerHandler{}
-	ListenAndServe(address, serverHandler, false)
+	srv := startTestServer(address, serverHandler)
+	defer srv.Close()
 	for i := 0; i < 10; i++ {
 		connection, err := Connect(address)
 		if err != nil {
@@ -128,7 +129,8 @@ func TestEcho(t *testing.T) {
 		go func() {
 			defer connection.Close()
 			data := DataStream("")
-			response, err := SendAndReceive(connection, clientHandler, &data)
+			//a handler per goroutine, as its buffer is not shared
+			response, err := SendAndReceive(connection, NewEchoClientHandler(), &data)
 			if string(response.Bytes()) != DefaultResponse || err != nil {
 				t.Errorf("failed in eccho \"hello world\": err: %v; received %q, expected %q\n", err, string(response.Bytes()), DefaultResponse)
 			}
@@ -138,38 +140,44 @@ func TestEcho(t *testing.T) {
 	wg.Wait()
 }
 
-/*
 func TestEchoSSL(t *testing.T) {
-	address := "localhost:9092"
-	message := "hello world"
+	address := TestAddr4
 	wg := &sync.WaitGroup{}
-	clientHandler := NewEchoClientHandler()
-	sCtx := NewEchoServerContext(message, false, 10)
-	ListenAndServeTLS(address, sCtx, "./keys/server.crt", "./keys/server.key")
+	serverConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	srv := NewServer(&EchoServerHandler{})
+	if err = srv.StartTLSConfig(address, serverConfig); err != nil {
+		t.Fatalf("failed to listen on %s: %v", address, err)
+	}
+	defer srv.Close()
 	for i := 0; i < 10; i++ {
-		connection, err := ConnectTLS(address, "localhost", false)
+		connection, err := ConnectTLSConfig(address, clientConfig)
 		if err != nil {
-			t.Error("error when connecting to %s: $v\n", address, err) 
+			t.Fatalf("error when connecting to %s: %v", address, err)
 		}
 		wg.Add(1)
 		go func() {
 			defer connection.Close()
-			rawResponse, _, err := SendAndReceive(connection, clientHandler, ([]byte)(message))
-			if string(rawResponse) != message || err != nil {
-				t.Errorf("failed in eccho \"hello world\": err: %v; received %q, expected %q\n", err, string(rawResponse), message)
+			data := DataStream("")
+			response, err := SendAndReceive(connection, NewEchoClientHandler(), &data)
+			if err != nil || string(response.Bytes()) != DefaultResponse {
+				t.Errorf("failed in eccho \"hello world\": err: %v; received %q, expected %q\n", err, responseString(response), DefaultResponse)
 			}
 			wg.Done()
 		}()
 	}
 	wg.Wait()
 }
-*/
+
 func BenchmarkEcho(b *testing.B) {
 	b.StopTimer()
 	address := TestAddr
 	clientHandler := NewEchoClientHandler()
 	serverHandler := &EchoServerHandler{}
-	ListenAndServe(address, serverHandler, false)
+	srv := startTestServer(address, serverHandler)
+	defer srv.Close()
 
 	connection, err := Connect(address)
 	if err != nil {
@@ -0,0 +1,235 @@
+/*
+ * Probe upstream backends in the background and leave out the unhealthy ones.
+ */
+
+package ptcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"golog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//DefaultHealthCheckTimeout bounds a check when the interval does not say otherwise
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+//DefaultHealthCheckInterval is how often backends are checked when no interval is given
+const DefaultHealthCheckInterval = 10 * time.Second
+
+//HealthCheck probes the backend at addr; it returns nil if the backend is healthy
+type HealthCheck interface {
+	Check(ctx context.Context, addr string) error
+}
+
+//HealthCheckFunc lets a function be used as a HealthCheck
+type HealthCheckFunc func(ctx context.Context, addr string) error
+
+func (f HealthCheckFunc) Check(ctx context.Context, addr string) error {
+	return f(ctx, addr)
+}
+
+//UnexpectedStatusError is returned by an HTTP health check that got the wrong status
+type UnexpectedStatusError struct {
+	Status   int
+	Expected int
+}
+
+func (e *UnexpectedStatusError) Error() string {
+	return fmt.Sprintf("health check returned status %d, expected %d", e.Status, e.Expected)
+}
+
+//TCPHealthCheck passes if a connection can be made; opts may be nil
+func TCPHealthCheck(opts *DialOptions) HealthCheck {
+	return HealthCheckFunc(func(ctx context.Context, addr string) error {
+		var plain DialOptions
+		if opts != nil {
+			plain = *opts
+		}
+		plain.TLSConfig = nil
+		connection, err := ConnectContext(ctx, addr, &plain)
+		if err != nil {
+			return err
+		}
+		return connection.Close()
+	})
+}
+
+//TLSHealthCheck passes if a TLS handshake with config succeeds; opts may be nil
+func TLSHealthCheck(config *tls.Config, opts *DialOptions) HealthCheck {
+	return HealthCheckFunc(func(ctx context.Context, addr string) error {
+		var secure DialOptions
+		if opts != nil {
+			secure = *opts
+		}
+		secure.TLSConfig = config
+		connection, err := ConnectContext(ctx, addr, &secure)
+		if err != nil {
+			return err
+		}
+		return connection.Close()
+	})
+}
+
+/*
+ * HttpHealthCheck sends a request for Path through HttpClientHandler on a new
+ * connection, and passes if the response has the ExpectedStatus.
+ */
+type HttpHealthCheck struct {
+	Method string //zero means GET
+	Path   string //zero means /
+	Host   string //the Host header; zero means the address of the backend
+	//ExpectedStatus is the status of a healthy backend; zero means 200
+	ExpectedStatus int
+	DialOptions    DialOptions //TLSConfig is set for HTTPS
+}
+
+func (check *HttpHealthCheck) request(addr string) (*UpstreamHttpRequest, error) {
+	method, path, host := check.Method, check.Path, check.Host
+	if method == "" {
+		method = "GET"
+	}
+	if path == "" {
+		path = "/"
+	}
+	if host == "" {
+		host = addr
+	}
+	raw := []byte(method + " " + path + " HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n")
+	httpRequest, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(raw)))
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamHttpRequest{HttpRequest: httpRequest, Ssl: check.DialOptions.TLSConfig != nil, Request: raw}, nil
+}
+
+func (check *HttpHealthCheck) Check(ctx context.Context, addr string) error {
+	request, err := check.request(addr)
+	if err != nil {
+		return err
+	}
+	connection, err := ConnectContext(ctx, addr, &check.DialOptions)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	//the dial timeouts do not cover the exchange
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.SetDeadline(deadline)
+	}
+	connection.EnableSaveReadData()
+	response, err := SendAndReceive(connection, &HttpClientHandler{}, request)
+	if err != nil {
+		return err
+	}
+	expected := check.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if status := response.(*UpstreamHttpResponse).HttpResponse.StatusCode; status != expected {
+		return &UnexpectedStatusError{Status: status, Expected: expected}
+	}
+	return nil
+}
+
+//BackendHealth is the state of a backend of an Upstream
+type BackendHealth struct {
+	Addr      string
+	Healthy   bool      //passed its last health check, or has not been checked
+	Ejected   bool      //left out after failing requests, see Upstream.MaxFails
+	LastCheck time.Time //zero if not checked yet
+	LastError error     //of the last health check
+}
+
+//Health returns the state of each backend
+func (u *Upstream) Health() []BackendHealth {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	now := time.Now()
+	health := make([]BackendHealth, len(u.backends))
+	for i, b := range u.backends {
+		health[i] = BackendHealth{
+			Addr:      b.addr,
+			Healthy:   !b.unhealthy,
+			Ejected:   now.Before(b.ejectedUntil),
+			LastCheck: b.lastCheck,
+			LastError: b.checkErr,
+		}
+	}
+	return health
+}
+
+func (u *Upstream) checkBackend(check HealthCheck, b *backend, timeout time.Duration, logger *golog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := check.Check(ctx, b.addr)
+	cancel()
+
+	u.mutex.Lock()
+	wasHealthy := !b.unhealthy
+	b.unhealthy = err != nil
+	b.lastCheck = time.Now()
+	b.checkErr = err
+	u.mutex.Unlock()
+	if wasHealthy && err != nil {
+		logger.Warning("Upstream backend %s failed its health check: %v", b.addr, err)
+	} else if !wasHealthy && err == nil {
+		logger.Notice("Upstream backend %s is healthy again", b.addr)
+	}
+}
+
+/*
+ * StartHealthChecks checks every backend right away and then every interval
+ * (DefaultHealthCheckInterval if zero), each check bounded by timeout: if
+ * zero, the interval given, or DefaultHealthCheckTimeout if that is zero too.
+ * Backends that fail a check get no new requests until they pass one. Changes of state are logged.
+ * Call the returned function to stop; it returns once the checks in progress
+ * are over.
+ */
+func (u *Upstream) StartHealthChecks(check HealthCheck, interval time.Duration, timeout time.Duration, logger *golog.Logger) (stop func()) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	quit := make(chan bool)
+	done := make(chan bool)
+	checkAll := func() {
+		var wg sync.WaitGroup
+		for _, b := range u.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				u.checkBackend(check, b, timeout, logger)
+			}(b)
+		}
+		wg.Wait()
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			checkAll()
+			select {
+			case <-ticker.C:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+		<-done
+	}
+}
@@ -0,0 +1,102 @@
+package ptcp
+
+import (
+	"context"
+	"crypto/tls"
+	"golog"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *golog.Logger {
+	logger := golog.NewLogger("")
+	logger.AddProcessor("console", golog.NewConsoleProcessor(golog.LOG_INFO, true))
+	return logger
+}
+
+func TestUpstreamHealthChecks(t *testing.T) {
+	srv := startTestServer(TestAddr3, &EchoServerHandler{})
+	defer srv.Close()
+	u := NewUpstream(nil, TestDeadAddr, TestAddr3)
+	defer u.Pool().Close()
+	stop := u.StartHealthChecks(TCPHealthCheck(nil), 20*time.Millisecond, 0, newTestLogger())
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for len(u.Available()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if available := u.Available(); len(available) != 1 || available[0] != TestAddr3 {
+		t.Fatalf("available backends %v, expected %s only", available, TestAddr3)
+	}
+	health := u.Health()
+	if health[0].Healthy || health[0].LastError == nil || health[0].LastCheck.IsZero() {
+		t.Errorf("unreachable backend reported as %+v", health[0])
+	}
+	if !health[1].Healthy || health[1].LastError != nil {
+		t.Errorf("reachable backend reported as %+v", health[1])
+	}
+	data := DataStream("")
+	for i := 0; i < 3; i++ {
+		if addr, err := u.Pick(&data); err != nil || addr != TestAddr3 {
+			t.Errorf("picked %s, %v; expected the healthy backend %s", addr, err, TestAddr3)
+		}
+	}
+}
+
+func TestUpstreamHealthChecksDefaultInterval(t *testing.T) {
+	u := NewUpstream(nil, TestDeadAddr)
+	defer u.Pool().Close()
+	//the first round of checks runs right away
+	stop := u.StartHealthChecks(TCPHealthCheck(nil), 0, 0, newTestLogger())
+	defer stop()
+	deadline := time.Now().Add(time.Second)
+	for len(u.Available()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if available := u.Available(); len(available) != 0 {
+		t.Errorf("available backends %v, expected none", available)
+	}
+}
+
+func TestHttpHealthCheck(t *testing.T) {
+	srv := startTestServer(TestAddr3, NewHttpServerHandler(newTestLogger(), 2, "test_health_srv"))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	check := &HttpHealthCheck{Path: "/health"}
+	if err := check.Check(ctx, TestAddr3); err != nil {
+		t.Errorf("HTTP health check failed: %v", err)
+	}
+	if err := (&HttpHealthCheck{}).Check(ctx, TestAddr3); err != nil {
+		t.Errorf("HTTP health check of / failed: %v", err)
+	}
+	check.ExpectedStatus = 204
+	err := check.Check(ctx, TestAddr3)
+	if statusErr, ok := err.(*UnexpectedStatusError); !ok || statusErr.Status != 200 {
+		t.Errorf("got %v, expected an UnexpectedStatusError for status 200", err)
+	}
+}
+
+func TestTLSHealthCheck(t *testing.T) {
+	serverConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	srv := NewServer(&EchoServerHandler{})
+	if err = srv.StartTLSConfig(TestAddr5, serverConfig); err != nil {
+		t.Fatalf("failed to listen on %s: %v", TestAddr5, err)
+	}
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err = TLSHealthCheck(clientConfig, nil).Check(ctx, TestAddr5); err != nil {
+		t.Errorf("TLS health check failed: %v", err)
+	}
+	//the server certificate is not trusted without the test CA
+	if err = TLSHealthCheck(&tls.Config{}, nil).Check(ctx, TestAddr5); err == nil {
+		t.Errorf("TLS health check passed with an untrusted certificate")
+	}
+}
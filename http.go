@@ -8,8 +8,9 @@ import (
 import "bytes"
 
 const (
-	DefaultErrorResponse = "HTTP/1.1 500\r\nConnection: close\r\nContent-Type: text/html;\r\nContent-Length: 21\r\n\r\nInternal Server Error"
-	DefaultOKResponse    = "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain;\r\nContent-Length: 2\r\n\r\nOK"
+	DefaultErrorResponse       = "HTTP/1.1 500\r\nConnection: close\r\nContent-Type: text/html;\r\nContent-Length: 21\r\n\r\nInternal Server Error"
+	DefaultOKResponse          = "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain;\r\nContent-Length: 2\r\n\r\nOK"
+	DefaultUnavailableResponse = "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Type: text/plain;\r\nContent-Length: 19\r\n\r\nService Unavailable"
 )
 
 var HttpHeaderBodySepSig = []byte("\r\n\r\n")
@@ -75,6 +76,20 @@ func (req *UpstreamHttpRequest) Bytes() []byte {
 	return req.Request
 }
 
+//Idempotent reports whether the request may be sent again after a failure:
+//its method is idempotent, or it carries an idempotency key
+func (req *UpstreamHttpRequest) Idempotent() bool {
+	if req.HttpRequest == nil {
+		return false
+	}
+	switch req.HttpRequest.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	header := req.HttpRequest.Header
+	return header.Get("Idempotency-Key") != "" || header.Get("X-Idempotency-Key") != ""
+}
+
 type UpstreamHttpResponse struct {
 	Header       http.Header
 	RawHeader    []byte
@@ -88,6 +103,11 @@ func (resp *UpstreamHttpResponse) Bytes() []byte {
 	return data
 }
 
+//WantsClose reports whether the upstream server asked to close the connection
+func (resp *UpstreamHttpResponse) WantsClose() bool {
+	return resp.HttpResponse != nil && resp.HttpResponse.Close
+}
+
 func SeparateHttpHeaderBody(raw []byte) (header, body []byte, err error) {
 	endOfHeader := bytes.Index(raw, HttpHeaderBodySepSig)
 	if endOfHeader < 0 {
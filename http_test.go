@@ -19,7 +19,8 @@ func TestHttpClientServer(t *testing.T) {
 	logger := golog.NewLogger("")
 	logger.AddProcessor("console", golog.NewConsoleProcessor(golog.LOG_INFO, true))
 	serverHandler := NewHttpServerHandler(logger, 4, "test_http_srv")
-	ListenAndServe(address, serverHandler, false)
+	srv := startTestServer(address, serverHandler)
+	defer srv.Close()
 	uHttpRequest := &UpstreamHttpRequest{}
 	uHttpRequest.Request = ([]byte)("GET / HTTP/1.1\r\n\r\n")
 
@@ -58,7 +59,8 @@ func BenchmarkHttpClientServer(b *testing.B) {
 	logger := golog.NewLogger("")
 	logger.AddProcessor("console", golog.NewConsoleProcessor(golog.LOG_INFO, true))
 	serverHandler := NewHttpServerHandler(logger, 1, "test_http_srv")
-	ListenAndServe(address, serverHandler, false)
+	srv := startTestServer(address, serverHandler)
+	defer srv.Close()
 	uHttpRequest := &UpstreamHttpRequest{}
 	uHttpRequest.Request = ([]byte)("GET / HTTP/1.1\r\nConnection: keep-alive\r\n\r\n")
 	buffer := bytes.NewBuffer(uHttpRequest.Request)
@@ -1,7 +1,6 @@
 package ptcp
 
 import (
-	"bufio"
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
@@ -25,13 +24,14 @@ func (hch *HttpClientHandler) Handle(connection *TcpConnection, request Request)
 		return
 	}
 
+	//the response is captured on its own, also on a reused connection
+	connection.MarkRawDataBoundary()
 	_, err = connection.Write(upstreamReq.Request)
 	if err != nil {
 		return
 	}
 
-	br := bufio.NewReader(connection)
-	httpResponse, err := http.ReadResponse(br, &http.Request{Method: upstreamReq.HttpRequest.Method})
+	httpResponse, err := http.ReadResponse(connection.Reader(), &http.Request{Method: upstreamReq.HttpRequest.Method})
 	if err != nil {
 		return
 	}
@@ -57,17 +57,23 @@ func (hch *HttpClientHandler) Handle(connection *TcpConnection, request Request)
 
 	//separate the raw response into header and body
 	rawResponse = connection.RawData()
-	RawHeader, RawBody, err := SeparateHttpHeaderBody(rawResponse)
-	if err != nil {
-		println("err here:", err.Error())
-		return
+	var RawHeader, RawBody []byte
+	//a response larger than the capture limit is not all in the raw response
+	overflowed := connection.CaptureOverflowed()
+	if !overflowed {
+		RawHeader, RawBody, err = SeparateHttpHeaderBody(rawResponse)
+		if err != nil {
+			println("err here:", err.Error())
+			return
+		}
 	}
 
 	uResponse.Body = RawBody
 
 	//detect if the raw response contains chunked encoding
 	//should use a regex
-	if bytes.Index(RawHeader, []byte("Transfer-Encoding:")) >= 0 && bytes.Index(RawHeader, []byte("chunked")) >= 0 {
+	//an overflowed response is rebuilt from the parsed one in the same way
+	if overflowed || bytes.Index(RawHeader, []byte("Transfer-Encoding:")) >= 0 && bytes.Index(RawHeader, []byte("chunked")) >= 0 {
 		//should use the TcpConnection's buffer
 		w := bytes.NewBuffer(nil)
 		if httpResponse.Request != nil {
@@ -1,7 +1,6 @@
 package ptcp
 
 import (
-	"bufio"
 	"fmt"
 	"golog"
 	"io"
@@ -53,6 +52,11 @@ func (h *HttpServerHandler) ConnectionQueueLength() int {
 	return DefaultConnectionQueueLength
 }
 
+//RejectResponse is sent to connections over the server's connection limit
+func (h *HttpServerHandler) RejectResponse() []byte {
+	return []byte(DefaultUnavailableResponse)
+}
+
 func (h *HttpServerHandler) Cleanup() {
 	return
 }
@@ -60,10 +64,10 @@ func (h *HttpServerHandler) Cleanup() {
 func (h *HttpServerHandler) Handle(connection *TcpConnection) (err error) {
 	uHttpRequest, err := h.ReceiveRequest(connection)
 	if err != nil {
-		if err != io.ErrUnexpectedEOF {
-			h.logger.Error("ReceiveDownstreamRequest error: %v", err)
-		} else {
+		if err == io.ErrUnexpectedEOF {
 			err = io.EOF //client has closed the connection?
+		} else if !IsTimeout(err) { //timeouts are logged by the server
+			h.logger.Error("ReceiveDownstreamRequest error: %v", err)
 		}
 		return
 	}
@@ -85,11 +89,11 @@ func (h *HttpServerHandler) Handle(connection *TcpConnection) (err error) {
 }
 
 func (h *HttpServerHandler) ReceiveRequest(connection *TcpConnection) (uHttpRequest *UpstreamHttpRequest, err error) {
-	br := bufio.NewReader(connection)
-	httpRequest, err := http.ReadRequest(br)
+	httpRequest, err := http.ReadRequest(connection.Reader())
 	if err != nil {
 		return
 	}
+	connection.BeginBody()
 	_, err = ioutil.ReadAll(httpRequest.Body)
 	if err != nil {
 		recvd := connection.RawData()
@@ -97,7 +101,9 @@ func (h *HttpServerHandler) ReceiveRequest(connection *TcpConnection) (uHttpRequ
 		return
 	}
 	rawRequest := connection.RawData()
-	if rawRequest == nil {
+	if connection.CaptureOverflowed() {
+		err = ErrorCaptureOverflow
+	} else if rawRequest == nil {
 		err = ErrorHttpServerShouldSaveReadData
 	}
 	uHttpRequest = &UpstreamHttpRequest{HttpRequest: httpRequest, Request: rawRequest}
@@ -0,0 +1,358 @@
+/*
+ * Reuse upstream connections across requests.
+ */
+
+package ptcp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxIdle        = 100
+	DefaultMaxIdlePerHost = 2
+)
+
+var ErrorPoolClosed = errors.New("Connection pool closed")
+
+//ClosingResponse is implemented by responses that can tell the connection must not be reused
+type ClosingResponse interface {
+	WantsClose() bool
+}
+
+//connections to the same address with the same TLS config are interchangeable
+type poolKey struct {
+	addr   string
+	config *tls.Config
+}
+
+type idleConnection struct {
+	connection *TcpConnection
+	since      time.Time
+}
+
+// Pool hands out connections to upstream servers, keeping those returned
+// after a successful exchange for reuse. Connections are pooled per address
+// and TLS config; the same *tls.Config must be passed to share them.
+type Pool struct {
+	//MaxIdle bounds the idle connections over all addresses; zero means DefaultMaxIdle
+	MaxIdle int
+	//MaxIdlePerHost bounds the idle connections per address; zero means DefaultMaxIdlePerHost
+	MaxIdlePerHost int
+	//MaxPerHost bounds the connections per address, idle or in use; zero means no limit.
+	//Get waits for a connection to be returned when the limit is reached.
+	MaxPerHost int
+	//IdleTimeout closes connections idle for longer, also for addresses no longer asked for; zero means never
+	IdleTimeout time.Duration
+	//DialOptions are used for new connections; TLSConfig is replaced by the one passed to Get
+	DialOptions DialOptions
+	//SaveReadData enables EnableSaveReadData on new connections, as HttpClientHandler needs;
+	//the handler marks where each response starts, see MarkRawDataBoundary
+	SaveReadData bool
+	//CaptureLimit bounds the data captured per response when SaveReadData is set
+	CaptureLimit CaptureLimit
+	//Retry decides whether SendAndReceive tries again; the zero value makes one attempt
+	Retry RetryPolicy
+
+	mutex     sync.Mutex
+	idle      map[poolKey][]idleConnection //most recently returned last
+	idleCount int
+	slots     map[poolKey]chan bool //one entry per open connection when MaxPerHost is set
+	owners    map[*TcpConnection]poolKey
+	closed    bool
+	expiring  bool //expireIdle is running
+}
+
+func NewPool() *Pool {
+	return &Pool{
+		idle:   make(map[poolKey][]idleConnection),
+		slots:  make(map[poolKey]chan bool),
+		owners: make(map[*TcpConnection]poolKey),
+	}
+}
+
+func (p *Pool) maxIdle() int {
+	if p.MaxIdle > 0 {
+		return p.MaxIdle
+	}
+	return DefaultMaxIdle
+}
+
+func (p *Pool) maxIdlePerHost() int {
+	if p.MaxIdlePerHost > 0 {
+		return p.MaxIdlePerHost
+	}
+	return DefaultMaxIdlePerHost
+}
+
+//must hold the mutex
+func (p *Pool) slotsFor(key poolKey) chan bool {
+	if p.MaxPerHost <= 0 {
+		return nil
+	}
+	slots, ok := p.slots[key]
+	if !ok {
+		slots = make(chan bool, p.MaxPerHost)
+		p.slots[key] = slots
+	}
+	return slots
+}
+
+//take the most recently returned idle connection that has not expired
+func (p *Pool) takeIdle(key poolKey) *TcpConnection {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for idle := p.idle[key]; len(idle) > 0; idle = p.idle[key] {
+		last := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+		p.idleCount--
+		if p.IdleTimeout > 0 && time.Since(last.since) > p.IdleTimeout {
+			p.closeLocked(last.connection)
+			continue
+		}
+		return last.connection
+	}
+	return nil
+}
+
+/*
+ * pruneLocked closes the idle connections that have expired, over all
+ * addresses, and returns when the next one expires; zero if none will.
+ * Must hold the mutex.
+ */
+func (p *Pool) pruneLocked(now time.Time) time.Time {
+	var next time.Time
+	if p.IdleTimeout <= 0 {
+		return next
+	}
+	for key, idle := range p.idle {
+		//the oldest come first
+		expired := 0
+		for ; expired < len(idle) && now.Sub(idle[expired].since) > p.IdleTimeout; expired++ {
+			p.closeLocked(idle[expired].connection)
+		}
+		p.idleCount -= expired
+		idle = idle[expired:]
+		if len(idle) == 0 {
+			delete(p.idle, key)
+			continue
+		}
+		p.idle[key] = idle
+		if expiry := idle[0].since.Add(p.IdleTimeout); next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+	return next
+}
+
+//expireIdle closes idle connections as they expire; it runs while some may
+func (p *Pool) expireIdle() {
+	for {
+		p.mutex.Lock()
+		next := p.pruneLocked(time.Now())
+		if next.IsZero() {
+			p.expiring = false
+			p.mutex.Unlock()
+			return
+		}
+		p.mutex.Unlock()
+		//just past the expiry, as pruneLocked closes only those idle for longer
+		time.Sleep(time.Until(next) + time.Millisecond)
+	}
+}
+
+//Get returns an idle connection to addr, or dials a new one.
+//config is nil for plain connections.
+func (p *Pool) Get(ctx context.Context, addr string, config *tls.Config) (*TcpConnection, error) {
+	connection, _, err := p.get(ctx, addr, config)
+	return connection, err
+}
+
+//get also tells whether the connection was used before
+func (p *Pool) get(ctx context.Context, addr string, config *tls.Config) (*TcpConnection, bool, error) {
+	key := poolKey{addr: addr, config: config}
+	for {
+		if p.isClosed() {
+			return nil, false, ErrorPoolClosed
+		}
+		if connection := p.takeIdle(key); connection != nil {
+			return connection, true, nil
+		}
+		p.mutex.Lock()
+		slots := p.slotsFor(key)
+		p.mutex.Unlock()
+		if slots == nil {
+			break
+		}
+		//wait for a free slot, looking for a returned connection now and then
+		acquired := false
+		select {
+		case slots <- true:
+			acquired = true
+		case <-time.After(poolRecheckInterval):
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if acquired {
+			break
+		}
+	}
+
+	opts := p.DialOptions
+	opts.TLSConfig = config
+	connection, err := ConnectContext(ctx, addr, &opts)
+	if err != nil {
+		p.release(key)
+		return nil, false, &ConnectError{Addr: addr, Err: err}
+	}
+	if p.SaveReadData {
+		connection.SetCaptureLimit(p.CaptureLimit)
+		connection.EnableSaveReadData()
+	}
+	p.mutex.Lock()
+	p.owners[connection] = key
+	p.mutex.Unlock()
+	return connection, false, nil
+}
+
+//how often a Get waiting on MaxPerHost looks for a returned connection
+const poolRecheckInterval = 10 * time.Millisecond
+
+func (p *Pool) isClosed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closed
+}
+
+func (p *Pool) release(key poolKey) {
+	p.mutex.Lock()
+	slots := p.slotsFor(key)
+	p.mutex.Unlock()
+	if slots != nil {
+		<-slots
+	}
+}
+
+//must hold the mutex
+func (p *Pool) closeLocked(connection *TcpConnection) {
+	connection.Close()
+	key, ok := p.owners[connection]
+	if !ok {
+		return
+	}
+	delete(p.owners, connection)
+	if slots := p.slotsFor(key); slots != nil {
+		<-slots
+	}
+}
+
+//Put returns a connection after a successful exchange so that it can be reused
+func (p *Pool) Put(connection *TcpConnection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key, ok := p.owners[connection]
+	if !ok {
+		//not from this pool, or already discarded
+		connection.Close()
+		return
+	}
+	if p.closed || p.idleCount >= p.maxIdle() || len(p.idle[key]) >= p.maxIdlePerHost() {
+		p.closeLocked(connection)
+		return
+	}
+	p.idle[key] = append(p.idle[key], idleConnection{connection: connection, since: time.Now()})
+	p.idleCount++
+	if p.IdleTimeout > 0 && !p.expiring {
+		p.expiring = true
+		go p.expireIdle()
+	}
+}
+
+//Discard closes a connection that must not be reused, e.g. after an error
+func (p *Pool) Discard(connection *TcpConnection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closeLocked(connection)
+}
+
+//IdleConnections returns the number of connections waiting to be reused
+func (p *Pool) IdleConnections() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.idleCount
+}
+
+//CloseIdle closes the idle connections
+func (p *Pool) CloseIdle() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, idle := range p.idle {
+		for _, c := range idle {
+			p.closeLocked(c.connection)
+		}
+		delete(p.idle, key)
+	}
+	p.idleCount = 0
+}
+
+//Close closes the idle connections; connections in use are closed when they are returned
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+	p.CloseIdle()
+}
+
+/*
+ * SendAndReceive sends a request on a pooled connection to addr. The connection
+ * is returned to the pool after a successful exchange, unless the response is a
+ * ClosingResponse that wants it closed; it is discarded on any error.
+ * Failed attempts are retried as the Retry policy allows.
+ */
+func (p *Pool) SendAndReceive(ctx context.Context, addr string, config *tls.Config, handler ClientHandler, request Request) (Response, error) {
+	if handler == nil {
+		return nil, ErrorMissingClientHandler
+	}
+	for attempt := 1; ; attempt++ {
+		response, retriable, err := p.sendAndReceiveOnce(ctx, addr, config, handler, request)
+		if err == nil || !retriable {
+			return response, err
+		}
+		_, connectFailed := err.(*ConnectError)
+		if !p.Retry.allows(attempt, request, !connectFailed) {
+			return response, err
+		}
+		if err = p.Retry.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//one attempt; retriable is set if the request is known not to have been processed
+func (p *Pool) sendAndReceiveOnce(ctx context.Context, addr string, config *tls.Config, handler ClientHandler, request Request) (response Response, retriable bool, err error) {
+	connection, reused, err := p.get(ctx, addr, config)
+	if err != nil {
+		//a certificate that fails verification will fail again
+		var verification *TLSVerificationError
+		_, retriable = err.(*ConnectError)
+		return nil, retriable && !errors.As(err, &verification), err
+	}
+	received := connection.BytesRead()
+	response, err = SendAndReceive(connection, handler, request)
+	if err != nil {
+		//a reused connection may have been closed by the server while idle
+		retriable = reused && connection.BytesRead() == received
+		p.Discard(connection)
+		return nil, retriable, err
+	}
+	if closing, ok := response.(ClosingResponse); ok && closing.WantsClose() {
+		p.Discard(connection)
+	} else {
+		p.Put(connection)
+	}
+	return response, false, nil
+}
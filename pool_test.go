@@ -0,0 +1,227 @@
+package ptcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"golog"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPoolReuse(t *testing.T) {
+	srv := startTestServer(TestAddr3, &EchoServerHandler{})
+	defer srv.Close()
+	pool := NewPool()
+	defer pool.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		data := DataStream("")
+		response, err := pool.SendAndReceive(ctx, TestAddr3, nil, NewEchoClientHandler(), &data)
+		if err != nil || responseString(response) != DefaultResponse {
+			t.Fatalf("exchange %d: got %q, %v", i, responseString(response), err)
+		}
+	}
+	if n := pool.IdleConnections(); n != 1 {
+		t.Errorf("%d idle connections, expected 1", n)
+	}
+	if n := srv.OpenConnections(); n != 1 {
+		t.Errorf("server has %d connections, expected the pooled one only", n)
+	}
+}
+
+func TestPoolLimits(t *testing.T) {
+	srv := startTestServer(TestAddr3, &EchoServerHandler{})
+	defer srv.Close()
+	pool := NewPool()
+	pool.MaxPerHost = 1
+	pool.IdleTimeout = 50 * time.Millisecond
+	defer pool.Close()
+
+	first, err := pool.Get(context.Background(), TestAddr3, nil)
+	if err != nil {
+		t.Fatalf("failed to get a connection: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = pool.Get(ctx, TestAddr3, nil); err != context.DeadlineExceeded {
+		t.Errorf("Get over MaxPerHost returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	pool.Put(first)
+	second, err := pool.Get(context.Background(), TestAddr3, nil)
+	if err != nil || second != first {
+		t.Errorf("Get after Put returned %p, %v; expected the idle connection %p", second, err, first)
+	}
+
+	pool.Put(second)
+	time.Sleep(2 * pool.IdleTimeout)
+	third, err := pool.Get(context.Background(), TestAddr3, nil)
+	if err != nil || third == second {
+		t.Errorf("Get after the idle timeout returned %p, %v; expected a new connection", third, err)
+	}
+	pool.Discard(third)
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	srv := startTestServer(TestAddr3, &EchoServerHandler{})
+	defer srv.Close()
+	pool := NewPool()
+	pool.MaxPerHost = 1
+	pool.IdleTimeout = 30 * time.Millisecond
+	defer pool.Close()
+
+	connection, err := pool.Get(context.Background(), TestAddr3, nil)
+	if err != nil {
+		t.Fatalf("failed to get a connection: %v", err)
+	}
+	pool.Put(connection)
+	//no one asks for the address again, yet the connection is closed
+	deadline := time.Now().Add(time.Second)
+	for (pool.IdleConnections() != 0 || srv.OpenConnections() != 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := pool.IdleConnections(); n != 0 {
+		t.Errorf("%d idle connections after the idle timeout, expected none", n)
+	}
+	if n := srv.OpenConnections(); n != 0 {
+		t.Errorf("server has %d connections after the idle timeout, expected none", n)
+	}
+
+	//a connection from elsewhere takes no slot
+	client, server := net.Pipe()
+	defer server.Close()
+	foreign, _ := NewTcpConnection(client)
+	pool.Discard(foreign)
+	if n := len(pool.slots); n != 1 {
+		t.Errorf("%d addresses with slots, expected only %s", n, TestAddr3)
+	}
+}
+
+func TestPoolClosingResponse(t *testing.T) {
+	logger := golog.NewLogger("")
+	logger.AddProcessor("console", golog.NewConsoleProcessor(golog.LOG_INFO, true))
+	srv := startTestServer(TestAddr3, NewHttpServerHandler(logger, 2, "test_pool_srv"))
+	defer srv.Close()
+	pool := NewPool()
+	pool.SaveReadData = true
+	defer pool.Close()
+
+	uHttpRequest := &UpstreamHttpRequest{Request: []byte("GET / HTTP/1.1\r\n\r\n")}
+	httpRequest, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(uHttpRequest.Request)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	uHttpRequest.HttpRequest = httpRequest
+	response, err := pool.SendAndReceive(context.Background(), TestAddr3, nil, &HttpClientHandler{}, uHttpRequest)
+	if err != nil || responseString(response) != DefaultOKResponse {
+		t.Fatalf("got %q, %v", responseString(response), err)
+	}
+	//DefaultOKResponse says "Connection: close"
+	if n := pool.IdleConnections(); n != 0 {
+		t.Errorf("%d idle connections after a closing response, expected 0", n)
+	}
+}
+
+//StrictEchoClientHandler fails when the connection is closed before the reply
+type StrictEchoClientHandler struct {
+	*EchoClientHandler
+}
+
+func (ech *StrictEchoClientHandler) Handle(connection *TcpConnection, request Request) (Response, error) {
+	response, err := ech.EchoClientHandler.Handle(connection, request)
+	if err == nil && len(response.Bytes()) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return response, err
+}
+
+func TestPoolRetryStaleConnection(t *testing.T) {
+	srv := NewServer(&EchoServerHandler{})
+	srv.Timeouts.Idle = 20 * time.Millisecond
+	if err := srv.Start(TestAddr3); err != nil {
+		t.Fatalf("failed to listen on %s: %v", TestAddr3, err)
+	}
+	defer srv.Close()
+	pool := NewPool()
+	defer pool.Close()
+	ctx := context.Background()
+
+	exchange := func() (Response, error) {
+		data := DataStream("")
+		return pool.SendAndReceive(ctx, TestAddr3, nil, &StrictEchoClientHandler{NewEchoClientHandler()}, &data)
+	}
+	if _, err := exchange(); err != nil {
+		t.Fatalf("first exchange failed: %v", err)
+	}
+	//the server closes the pooled connection while it is idle
+	time.Sleep(5 * srv.Timeouts.Idle)
+	if _, err := exchange(); err == nil {
+		t.Errorf("exchange on a stale connection without retries succeeded")
+	}
+
+	pool.Retry = RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond}
+	if _, err := exchange(); err != nil {
+		t.Fatalf("first exchange failed: %v", err)
+	}
+	time.Sleep(5 * srv.Timeouts.Idle)
+	//DataStream does not say it is idempotent
+	if _, err := exchange(); err == nil {
+		t.Errorf("non-idempotent request was retried")
+	}
+
+	pool.Retry.RetryNonIdempotent = true
+	if _, err := exchange(); err != nil {
+		t.Fatalf("first exchange failed: %v", err)
+	}
+	time.Sleep(5 * srv.Timeouts.Idle)
+	if response, err := exchange(); err != nil || responseString(response) != DefaultResponse {
+		t.Errorf("retried exchange got %q, %v", responseString(response), err)
+	}
+}
+
+func TestPoolRetryConnectFailure(t *testing.T) {
+	attempts := 0
+	pool := NewPool()
+	pool.DialOptions.Dialer = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		attempts++
+		return nil, errors.New("connection refused")
+	}
+	pool.Retry = RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond}
+	defer pool.Close()
+
+	data := DataStream("")
+	_, err := pool.SendAndReceive(context.Background(), TestAddr3, nil, NewEchoClientHandler(), &data)
+	if _, ok := err.(*ConnectError); !ok {
+		t.Errorf("got %v, expected a ConnectError", err)
+	}
+	if attempts != 3 {
+		t.Errorf("dialed %d times, expected 3", attempts)
+	}
+}
+
+func TestIdempotentHttpRequest(t *testing.T) {
+	for _, test := range []struct {
+		request    string
+		idempotent bool
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", true},
+		{"DELETE /item HTTP/1.1\r\n\r\n", true},
+		{"POST /items HTTP/1.1\r\nContent-Length: 0\r\n\r\n", false},
+		{"POST /items HTTP/1.1\r\nIdempotency-Key: 42\r\nContent-Length: 0\r\n\r\n", true},
+	} {
+		httpRequest, err := http.ReadRequest(bufio.NewReader(bytes.NewBufferString(test.request)))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		request := &UpstreamHttpRequest{HttpRequest: httpRequest, Request: []byte(test.request)}
+		if request.Idempotent() != test.idempotent {
+			t.Errorf("%q: Idempotent() = %v", test.request, !test.idempotent)
+		}
+	}
+}
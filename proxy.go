@@ -0,0 +1,300 @@
+/*
+ * Reach upstream servers through SOCKS5 and HTTP CONNECT proxies.
+ */
+
+package ptcp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var ErrorProxyAuthentication = errors.New("Proxy authentication failed")
+
+//ProxyError is returned when a proxy will not connect to Addr
+type ProxyError struct {
+	Proxy  string
+	Addr   string
+	Reason string
+}
+
+func (e *ProxyError) Error() string {
+	return "proxy " + e.Proxy + " failed to connect to " + e.Addr + ": " + e.Reason
+}
+
+//dial the proxy itself
+func dialProxy(ctx context.Context, forward DialFunc, proxyAddr string) (net.Conn, error) {
+	if forward == nil {
+		forward = (&net.Dialer{}).DialContext
+	}
+	return forward(ctx, "tcp", proxyAddr)
+}
+
+//run the handshake with a proxy, closing the connection if ctx is done first
+func proxyHandshake(ctx context.Context, conn net.Conn, handshake func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	done := make(chan bool)
+	watcher := make(chan bool)
+	go func() {
+		defer close(watcher)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err := handshake()
+	close(done)
+	<-watcher
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+/*
+ * SOCKS5Dialer connects through a SOCKS5 proxy (RFC 1928), authenticating with
+ * Username and Password (RFC 1929) if they are set. Set its Dial method as the
+ * Dialer of DialOptions; TLS, if configured, then runs through the tunnel.
+ * Host names are resolved by the proxy.
+ */
+type SOCKS5Dialer struct {
+	ProxyAddr string
+	Username  string
+	Password  string
+	Forward   DialFunc //dials the proxy; nil means a plain TCP dial
+}
+
+const (
+	socks5Version    = 5
+	socks5NoAuth     = 0
+	socks5UserPass   = 2
+	socks5Connect    = 1
+	socks5IPv4       = 1
+	socks5DomainName = 3
+	socks5IPv6       = 4
+)
+
+var socks5Replies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func (d *SOCKS5Dialer) Dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, d.Forward, d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	err = proxyHandshake(ctx, conn, func() error {
+		return d.handshake(conn, addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *SOCKS5Dialer) handshake(conn net.Conn, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5NoAuth)
+	if d.Username != "" {
+		method = socks5UserPass
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return &ProxyError{Proxy: d.ProxyAddr, Addr: addr, Reason: "no acceptable authentication method"}
+	}
+	if method == socks5UserPass {
+		if err = d.authenticate(conn); err != nil {
+			return err
+		}
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return &ProxyError{Proxy: d.ProxyAddr, Addr: addr, Reason: "host name too long"}
+		}
+		request = append(request, socks5DomainName, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5IPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5IPv6)
+		request = append(request, ip...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	//VER REP RSV ATYP, then the bound address and port, which are not needed
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		reason := "unknown error"
+		if int(header[1]) < len(socks5Replies) {
+			reason = socks5Replies[header[1]]
+		}
+		return &ProxyError{Proxy: d.ProxyAddr, Addr: addr, Reason: reason}
+	}
+	var skip int
+	switch header[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5DomainName:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return &ProxyError{Proxy: d.ProxyAddr, Addr: addr, Reason: "unknown address type in reply"}
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return ErrorProxyAuthentication
+	}
+	request := []byte{1, byte(len(d.Username))}
+	request = append(request, d.Username...)
+	request = append(request, byte(len(d.Password)))
+	request = append(request, d.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return ErrorProxyAuthentication
+	}
+	return nil
+}
+
+/*
+ * HttpProxyDialer connects through an HTTP proxy with the CONNECT method,
+ * sending basic credentials if Username is set. Set its Dial method as the
+ * Dialer of DialOptions; TLS, if configured, then runs through the tunnel.
+ */
+type HttpProxyDialer struct {
+	ProxyAddr string
+	Username  string
+	Password  string
+	Header    http.Header //extra headers for the CONNECT request
+	TLSConfig *tls.Config //talk to the proxy itself over TLS if not nil
+	Forward   DialFunc    //dials the proxy; nil means a plain TCP dial
+}
+
+//bufferedConn returns what the reader of the proxy's reply read ahead before reading the connection.
+//It also hides a TLS connection to the proxy, which is not the TLS of the tunnel.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(data []byte) (int, error) {
+	if conn.reader.Buffered() > 0 {
+		return conn.reader.Read(data)
+	}
+	return conn.Conn.Read(data)
+}
+
+func (d *HttpProxyDialer) Dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, d.Forward, d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.TLSConfig != nil {
+		conn = tls.Client(conn, withServerName(d.TLSConfig, d.ProxyAddr))
+	}
+	var reader *bufio.Reader
+	err = proxyHandshake(ctx, conn, func() (err error) {
+		reader, err = d.handshake(conn, addr)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	//the upstream server may have spoken first
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+func (d *HttpProxyDialer) handshake(conn net.Conn, addr string) (*bufio.Reader, error) {
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	for key, values := range d.Header {
+		request.Header[key] = values
+	}
+	if d.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	//on failure the connection is closed without reading the body
+	switch {
+	case response.StatusCode == http.StatusProxyAuthRequired:
+		return nil, ErrorProxyAuthentication
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return nil, &ProxyError{Proxy: d.ProxyAddr, Addr: addr, Reason: response.Status}
+	}
+	response.Body.Close()
+	return reader, nil
+}
@@ -0,0 +1,173 @@
+package ptcp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+const TestProxyAddr = "localhost:13257"
+
+//startProxy listens on TestProxyAddr, over TLS if config is not nil, and hands each
+//connection to handshake, which returns the address to connect to, or an empty string to refuse
+func startProxy(t *testing.T, config *tls.Config, handshake func(conn net.Conn, reader *bufio.Reader) string) net.Listener {
+	listener, err := net.Listen("tcp", TestProxyAddr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", TestProxyAddr, err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				addr := handshake(conn, reader)
+				if addr == "" {
+					return
+				}
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, reader)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return listener
+}
+
+//a SOCKS5 proxy that only accepts user "user" with password "secret"
+func socks5Handshake(conn net.Conn, reader *bufio.Reader) string {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(reader, greeting); err != nil || greeting[2] != socks5UserPass {
+		conn.Write([]byte{socks5Version, 0xff})
+		return ""
+	}
+	conn.Write([]byte{socks5Version, socks5UserPass})
+	auth := make([]byte, 2)
+	io.ReadFull(reader, auth)
+	user := make([]byte, auth[1])
+	io.ReadFull(reader, user)
+	passwordLength, _ := reader.ReadByte()
+	password := make([]byte, passwordLength)
+	io.ReadFull(reader, password)
+	if string(user) != "user" || string(password) != "secret" {
+		conn.Write([]byte{1, 1})
+		return ""
+	}
+	conn.Write([]byte{1, 0})
+
+	header := make([]byte, 5)
+	io.ReadFull(reader, header)
+	if header[3] != socks5DomainName {
+		return ""
+	}
+	host := make([]byte, header[4])
+	io.ReadFull(reader, host)
+	port := make([]byte, 2)
+	io.ReadFull(reader, port)
+	conn.Write([]byte{socks5Version, 0, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(string(host), strconv.Itoa(int(port[0])<<8|int(port[1])))
+}
+
+//an HTTP proxy that only accepts user "user" with password "secret"
+func connectHandshake(conn net.Conn, reader *bufio.Reader) string {
+	request, err := http.ReadRequest(reader)
+	if err != nil || request.Method != "CONNECT" {
+		return ""
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if request.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+		return ""
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return request.Host
+}
+
+func exchangeThroughProxy(dialer DialFunc, opts DialOptions) (string, error) {
+	opts.Dialer = dialer
+	connection, err := ConnectContext(context.Background(), TestAddr5, &opts)
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+	data := DataStream("")
+	response, err := SendAndReceive(connection, NewEchoClientHandler(), &data)
+	return responseString(response), err
+}
+
+func TestProxyDialers(t *testing.T) {
+	serverConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	srv := NewServer(&EchoServerHandler{})
+	if err = srv.StartTLSConfig(TestAddr5, serverConfig); err != nil {
+		t.Fatalf("failed to listen on %s: %v", TestAddr5, err)
+	}
+	defer srv.Close()
+	opts := DialOptions{TLSConfig: clientConfig}
+
+	for _, test := range []struct {
+		name      string
+		handshake func(net.Conn, *bufio.Reader) string
+		dialer    func(password string) DialFunc
+	}{
+		{"SOCKS5", socks5Handshake, func(password string) DialFunc {
+			return (&SOCKS5Dialer{ProxyAddr: TestProxyAddr, Username: "user", Password: password}).Dial
+		}},
+		{"CONNECT", connectHandshake, func(password string) DialFunc {
+			return (&HttpProxyDialer{ProxyAddr: TestProxyAddr, Username: "user", Password: password}).Dial
+		}},
+	} {
+		proxy := startProxy(t, nil, test.handshake)
+		if reply, err := exchangeThroughProxy(test.dialer("secret"), opts); err != nil || reply != DefaultResponse {
+			t.Errorf("%s: got %q, %v through the proxy", test.name, reply, err)
+		}
+		if _, err := exchangeThroughProxy(test.dialer("wrong"), opts); err != ErrorProxyAuthentication {
+			t.Errorf("%s: got %v with a wrong password, expected %v", test.name, err, ErrorProxyAuthentication)
+		}
+		proxy.Close()
+	}
+}
+
+func TestHttpProxyDialerOverTLS(t *testing.T) {
+	srv := startTestServer(TestAddr5, &EchoServerHandler{})
+	defer srv.Close()
+	proxyConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	proxy := startProxy(t, proxyConfig, connectHandshake)
+	defer proxy.Close()
+
+	dialer := &HttpProxyDialer{ProxyAddr: TestProxyAddr, Username: "user", Password: "secret", TLSConfig: clientConfig}
+	connection, err := ConnectContext(context.Background(), TestAddr5, &DialOptions{Dialer: dialer.Dial})
+	if err != nil {
+		t.Fatalf("failed to connect through the proxy: %v", err)
+	}
+	defer connection.Close()
+	//the TLS to the proxy is not the connection's
+	if connection.TLSState() != nil || connection.PeerIdentity() != nil {
+		t.Errorf("plain connection through a TLS proxy reports the TLS state of the proxy")
+	}
+	data := DataStream("")
+	if response, err := SendAndReceive(connection, NewEchoClientHandler(), &data); err != nil || responseString(response) != DefaultResponse {
+		t.Errorf("got %q, %v through the proxy", responseString(response), err)
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * Record the traffic of a connection to a file, and replay one side of a
+ * recording against a handler without a network.
+ *
+ * A recording starts with the line "ptcp-recording 1", followed by the length
+ * of a JSON RecordingHeader (4 bytes, big endian) and the header itself. The
+ * rest are TeeFrames as written by SetTee, up to the end of the file. The data
+ * in the frames is the plain text, also for TLS connections.
+ */
+
+package ptcp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+//recordingMagic opens every recording; the number is the version of the format
+const recordingMagic = "ptcp-recording 1\n"
+
+//DefaultReplayTimeout bounds each step of a replay
+const DefaultReplayTimeout = 5 * time.Second
+
+//how long a replay waits for data the recording does not have
+const replayTailWait = 50 * time.Millisecond
+
+var ErrorInvalidRecording = errors.New("Not a ptcp recording")
+
+//RecordingSide is the side of the connection a recording was made on
+type RecordingSide string
+
+const (
+	RecordClient RecordingSide = "client"
+	RecordServer RecordingSide = "server"
+)
+
+//RecordedTLS is the state of the TLS connection a recording was made on
+type RecordedTLS struct {
+	Version            uint16
+	CipherSuite        uint16
+	ServerName         string
+	NegotiatedProtocol string
+	DidResume          bool
+	PeerCertificates   [][]byte //DER, leaf first
+}
+
+type RecordingHeader struct {
+	Side       RecordingSide
+	LocalAddr  string
+	RemoteAddr string
+	Start      time.Time
+	TLS        *RecordedTLS `json:",omitempty"`
+}
+
+//Recording is a recorded connection read back by ReadRecording
+type Recording struct {
+	Header RecordingHeader
+	Frames []*TeeFrame
+}
+
+/*
+ * StartRecording writes the header of a recording of connection to w, and
+ * then copies its traffic to w, see SetTee. side is the side of the connection
+ * the recording is made on. Call SetTee(nil) to stop recording.
+ */
+func StartRecording(connection *TcpConnection, side RecordingSide, w io.Writer) error {
+	header := RecordingHeader{
+		Side:       side,
+		LocalAddr:  connection.LocalAddr().String(),
+		RemoteAddr: connection.RemoteAddr().String(),
+		Start:      time.Now(),
+	}
+	if state := connection.TLSState(); state != nil {
+		header.TLS = &RecordedTLS{
+			Version:            state.Version,
+			CipherSuite:        state.CipherSuite,
+			ServerName:         state.ServerName,
+			NegotiatedProtocol: state.NegotiatedProtocol,
+			DidResume:          state.DidResume,
+		}
+		for _, cert := range state.PeerCertificates {
+			header.TLS.PeerCertificates = append(header.TLS.PeerCertificates, cert.Raw)
+		}
+	}
+	encoded, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, len(recordingMagic)+4, len(recordingMagic)+4+len(encoded))
+	copy(data, recordingMagic)
+	binary.BigEndian.PutUint32(data[len(recordingMagic):], uint32(len(encoded)))
+	data = append(data, encoded...)
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	connection.SetTee(w)
+	return nil
+}
+
+//ReadRecording reads a whole recording
+func ReadRecording(r io.Reader) (*Recording, error) {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != recordingMagic {
+		return nil, ErrorInvalidRecording
+	}
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, ErrorInvalidRecording
+	}
+	encoded := make([]byte, binary.BigEndian.Uint32(length))
+	if _, err := io.ReadFull(reader, encoded); err != nil {
+		return nil, ErrorInvalidRecording
+	}
+	recording := &Recording{}
+	if err := json.Unmarshal(encoded, &recording.Header); err != nil {
+		return nil, err
+	}
+	for {
+		frame, err := ReadTeeFrame(reader)
+		if err == io.EOF {
+			return recording, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		recording.Frames = append(recording.Frames, frame)
+	}
+}
+
+func LoadRecording(file string) (*Recording, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRecording(f)
+}
+
+//the direction of the frames with the data the client sent
+func (recording *Recording) clientDirection() TeeDirection {
+	if recording.Header.Side == RecordClient {
+		return TeeWrite
+	}
+	return TeeRead
+}
+
+func (recording *Recording) data(direction TeeDirection) []byte {
+	var data []byte
+	for _, frame := range recording.Frames {
+		if frame.Direction == direction {
+			data = append(data, frame.Data...)
+		}
+	}
+	return data
+}
+
+//ClientData returns all the data the client sent
+func (recording *Recording) ClientData() []byte {
+	return recording.data(recording.clientDirection())
+}
+
+//ServerData returns all the data the server sent
+func (recording *Recording) ServerData() []byte {
+	if recording.clientDirection() == TeeWrite {
+		return recording.data(TeeRead)
+	}
+	return recording.data(TeeWrite)
+}
+
+//tlsState rebuilds the state of the recorded TLS connection, nil for a plain one
+func (recording *Recording) tlsState() (*tls.ConnectionState, error) {
+	recorded := recording.Header.TLS
+	if recorded == nil {
+		return nil, nil
+	}
+	state := &tls.ConnectionState{
+		Version:            recorded.Version,
+		HandshakeComplete:  true,
+		DidResume:          recorded.DidResume,
+		CipherSuite:        recorded.CipherSuite,
+		NegotiatedProtocol: recorded.NegotiatedProtocol,
+		ServerName:         recorded.ServerName,
+	}
+	for _, der := range recorded.PeerCertificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		state.PeerCertificates = append(state.PeerCertificates, cert)
+	}
+	return state, nil
+}
+
+//ReplayMismatchError is returned when the handler in a replay does not send what was recorded
+type ReplayMismatchError struct {
+	Offset   int64  //in the data the handler sent
+	Expected []byte //the recorded data from Offset on, as far as it was compared
+	Got      []byte
+}
+
+func (e *ReplayMismatchError) Error() string {
+	return fmt.Sprintf("replay mismatch at byte %d: expected %q, got %q", e.Offset, e.Expected, e.Got)
+}
+
+/*
+ * play acts out one side of the recording on conn: it sends the frames in the
+ * direction send, and expects the others to arrive in turn. The data that
+ * arrives need not be split into the same frames.
+ */
+func (recording *Recording) play(conn net.Conn, send TeeDirection) error {
+	var offset int64
+	for _, frame := range recording.Frames {
+		conn.SetDeadline(time.Now().Add(DefaultReplayTimeout))
+		if frame.Direction == send {
+			if _, err := conn.Write(frame.Data); err != nil {
+				return err
+			}
+			continue
+		}
+		//compare as the data arrives, so that a mismatch is found without waiting for the rest
+		got := make([]byte, len(frame.Data))
+		for n := 0; n < len(got); {
+			m, err := conn.Read(got[n:])
+			n += m
+			if i := mismatch(frame.Data, got[:n]); i >= 0 || err != nil {
+				if i < 0 {
+					i = n
+				}
+				return &ReplayMismatchError{Offset: offset + int64(i), Expected: frame.Data[i:], Got: got[i:n]}
+			}
+		}
+		offset += int64(len(got))
+	}
+	//anything more was not recorded
+	conn.SetReadDeadline(time.Now().Add(replayTailWait))
+	extra := make([]byte, ReadBufferLength)
+	if n, _ := conn.Read(extra); n > 0 {
+		return &ReplayMismatchError{Offset: offset, Got: extra[:n]}
+	}
+	return nil
+}
+
+//the index of the first byte in got that differs from expected, or -1 if got is a prefix of it
+func mismatch(expected []byte, got []byte) int {
+	for i := range got {
+		if got[i] != expected[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+//a connection for the handler in a replay, looking like the recorded one
+func (recording *Recording) replayConnection(conn net.Conn) (*TcpConnection, error) {
+	state, err := recording.tlsState()
+	if err != nil {
+		return nil, err
+	}
+	connection, _ := NewTcpConnection(conn)
+	connection.tlsState = state
+	connection.EnableSaveReadData()
+	return connection, nil
+}
+
+/*
+ * ReplayToServer plays the client side of the recording against h, which
+ * handles the requests as it would for a Server, and checks that it sends
+ * back what the server sent. It returns a *ReplayMismatchError if it does not.
+ */
+func ReplayToServer(recording *Recording, h ServerHandler) error {
+	client, server := net.Pipe()
+	defer client.Close()
+	connection, err := recording.replayConnection(server)
+	if err != nil {
+		return err
+	}
+	handled := make(chan error, 1)
+	go func() {
+		defer connection.Close()
+		for {
+			if err := connection.WaitForData(); err != nil {
+				handled <- nil
+				return
+			}
+			connection.MarkRawDataBoundary()
+			if err := h.Handle(connection); err != nil {
+				if err == ErrorClientCloseConnection || err == ErrorServerCloseConnection {
+					err = nil
+				}
+				handled <- err
+				return
+			}
+		}
+	}()
+
+	err = recording.play(client, recording.clientDirection())
+	client.Close()
+	if handlerErr := <-handled; err == nil && handlerErr != nil && handlerErr != io.EOF {
+		err = handlerErr
+	}
+	return err
+}
+
+/*
+ * ReplayToClient plays the server side of the recording against h, and checks
+ * that h sends request as the client did. It returns what h returns, or a
+ * *ReplayMismatchError if h did not send what was recorded.
+ */
+func ReplayToClient(recording *Recording, h ClientHandler, request Request) (Response, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	connection, err := recording.replayConnection(client)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		response Response
+		err      error
+	}
+	handled := make(chan result, 1)
+	go func() {
+		response, err := SendAndReceive(connection, h, request)
+		handled <- result{response, err}
+	}()
+
+	serverDirection := TeeWrite
+	if recording.clientDirection() == TeeWrite {
+		serverDirection = TeeRead
+	}
+	err = recording.play(server, serverDirection)
+	server.Close()
+	outcome := <-handled
+	connection.Close()
+	if err != nil {
+		return nil, err
+	}
+	return outcome.response, outcome.err
+}
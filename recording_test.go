@@ -0,0 +1,88 @@
+package ptcp
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+//record an HTTP exchange over TLS on the client side
+func recordHttpExchange(t *testing.T) (*Recording, *UpstreamHttpRequest) {
+	serverConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	srv := NewServer(NewHttpServerHandler(newTestLogger(), 1, "test_record_srv"))
+	if err = srv.StartTLSConfig(TestAddr5, serverConfig); err != nil {
+		t.Fatalf("failed to listen on %s: %v", TestAddr5, err)
+	}
+	defer srv.Close()
+
+	connection, err := ConnectTLSConfig(TestAddr5, clientConfig)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer connection.Close()
+	connection.EnableSaveReadData()
+	recorded := &bytes.Buffer{}
+	if err = StartRecording(connection, RecordClient, recorded); err != nil {
+		t.Fatalf("failed to start recording: %v", err)
+	}
+
+	uHttpRequest := &UpstreamHttpRequest{Request: []byte("GET /recorded HTTP/1.1\r\nHost: localhost\r\n\r\n")}
+	if uHttpRequest.HttpRequest, err = http.ReadRequest(bufio.NewReader(bytes.NewBuffer(uHttpRequest.Request))); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err = SendAndReceive(connection, &HttpClientHandler{}, uHttpRequest); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	connection.SetTee(nil)
+
+	recording, err := ReadRecording(recorded)
+	if err != nil {
+		t.Fatalf("failed to read the recording: %v", err)
+	}
+	return recording, uHttpRequest
+}
+
+func TestRecording(t *testing.T) {
+	recording, uHttpRequest := recordHttpExchange(t)
+	if recording.Header.Side != RecordClient || recording.Header.RemoteAddr == "" {
+		t.Errorf("got header %+v", recording.Header)
+	}
+	if recorded := recording.Header.TLS; recorded == nil || recorded.Version == 0 || len(recorded.PeerCertificates) != 1 {
+		t.Errorf("got TLS state %+v", recorded)
+	}
+	if data := string(recording.ClientData()); data != string(uHttpRequest.Request) {
+		t.Errorf("recorded client data %q", data)
+	}
+	if data := string(recording.ServerData()); data != DefaultOKResponse {
+		t.Errorf("recorded server data %q", data)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	recording, uHttpRequest := recordHttpExchange(t)
+
+	if err := ReplayToServer(recording, NewHttpServerHandler(newTestLogger(), 1, "test_replay_srv")); err != nil {
+		t.Errorf("replay to the HTTP server handler failed: %v", err)
+	}
+	response, err := ReplayToClient(recording, &HttpClientHandler{}, uHttpRequest)
+	if err != nil || responseString(response) != DefaultOKResponse {
+		t.Errorf("replay to the HTTP client handler got %q, %v", responseString(response), err)
+	}
+
+	//a handler that answers differently is caught
+	echo, _ := (&EchoServerHandler{}).Spawn()
+	err = ReplayToServer(recording, echo.(ServerHandler))
+	if mismatch, ok := err.(*ReplayMismatchError); !ok || mismatch.Offset != 0 {
+		t.Errorf("replay to the echo handler returned %v, expected a mismatch at byte 0", err)
+	}
+	other := *uHttpRequest
+	other.Request = []byte("GET /other HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, err = ReplayToClient(recording, &HttpClientHandler{}, &other)
+	if mismatch, ok := err.(*ReplayMismatchError); !ok || mismatch.Offset != int64(len("GET /")) {
+		t.Errorf("replay of a different request returned %v, expected a mismatch at byte %d", err, len("GET /"))
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Retry upstream requests that failed before reaching the server.
+ */
+
+package ptcp
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultBaseBackoff = 10 * time.Millisecond
+	DefaultMaxBackoff  = 1 * time.Second
+)
+
+//IdempotentRequest is implemented by requests that know whether sending them twice is safe
+type IdempotentRequest interface {
+	Idempotent() bool
+}
+
+//ConnectError is returned when no connection could be made, so the request was not sent
+type ConnectError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	return "failed to connect to " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+/*
+ * RetryPolicy decides how a Pool retries a request. Only failures that happen
+ * before the server could have seen the request are retried: a failed connect,
+ * or a reused connection that fails before any byte of the response arrives.
+ * In the second case the request has been written, so it is only retried if
+ * it is an IdempotentRequest that says so, or if RetryNonIdempotent is set.
+ */
+type RetryPolicy struct {
+	//MaxAttempts counts the first attempt; zero or one means no retries
+	MaxAttempts int
+	//BaseBackoff is the cap of the first wait, doubled on each retry up to MaxBackoff.
+	//The wait is a random fraction of the cap (full jitter).
+	BaseBackoff        time.Duration
+	MaxBackoff         time.Duration
+	RetryNonIdempotent bool
+}
+
+//whether another attempt may follow the given one; sent tells whether the request was written
+func (policy *RetryPolicy) allows(attempt int, request Request, sent bool) bool {
+	if attempt >= policy.MaxAttempts {
+		return false
+	}
+	if !sent || policy.RetryNonIdempotent {
+		return true
+	}
+	idempotent, ok := request.(IdempotentRequest)
+	return ok && idempotent.Idempotent()
+}
+
+//wait before the attempt following the given one
+func (policy *RetryPolicy) wait(ctx context.Context, attempt int) error {
+	base := policy.BaseBackoff
+	if base <= 0 {
+		base = DefaultBaseBackoff
+	}
+	max := policy.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	backoff := base
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
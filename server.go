@@ -13,12 +13,15 @@
 package ptcp
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/tls"
 	"errors"
 	"golog"
 	"io"
 	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,81 +38,573 @@ type ServerHandler interface {
 	ConnectionQueueLength() int
 }
 
+//Rejecter is implemented by server handlers that have a protocol specific reply
+//for connections rejected because the server is at its connection limit
+type Rejecter interface {
+	RejectResponse() []byte
+}
+
+//OverLimitPolicy decides what happens to a connection accepted beyond Server.MaxConnections
+type OverLimitPolicy int
+
+const (
+	RejectOverLimit OverLimitPolicy = iota //reply with the handler's RejectResponse, if any, and close
+	CloseOverLimit                         //close without a reply
+	WaitOverLimit                          //stop accepting until a connection closes or OverLimitWait elapses, then reject
+)
+
 var (
 	ErrHandlerLimitReached     = errors.New("Handler limit reached")
 	ErrorClientCloseConnection = io.EOF
 	ErrorServerCloseConnection = errors.New("server needs to close the connection")
+	ErrServerClosed            = errors.New("Server closed")
+	ErrorHandlerPanic          = errors.New("Server handler panicked")
 )
 
-func handleConnections(connectionQueue chan *TcpConnection, h ServerHandler) {
+const (
+	//how often Shutdown checks whether the in-flight connections are done
+	shutdownPollInterval = 50 * time.Millisecond
+	//bounds of the back-off after a temporary accept error
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+	//how long to try writing the reply to a rejected connection
+	rejectWriteTimeout = 1 * time.Second
+)
+
+type connectionState int
+
+const (
+	stateIdle   connectionState = iota //waiting for a request or in the connection queue
+	stateActive                        //being handled by a spawned handler
+)
+
+//handlerPool is the handlers spawned from one ServerHandler and the queue they share
+type handlerPool struct {
+	handler         ServerHandler
+	connectionQueue chan *TcpConnection
+}
+
+// Server accepts connections on a listener and shares them among the
+// handlers spawned from Handler, or from the handler registered with
+// HandleProtocol for the protocol negotiated over TLS (ALPN).
+// Unlike the package level ListenAndServe, a Server can be stopped with Shutdown or Close.
+type Server struct {
+	Handler ServerHandler
+	//ErrorHandler, if set, is called with the error that terminated a server started by Start
+	ErrorHandler func(error)
+	//Timeouts applied to every accepted connection
+	Timeouts Timeouts
+	//MaxConnections limits the number of open connections; zero means no limit
+	MaxConnections  int
+	OverLimitPolicy OverLimitPolicy
+	//OverLimitWait bounds how long WaitOverLimit waits for a free slot; zero means forever
+	OverLimitWait time.Duration
+	//CaptureLimit bounds the data captured per request, see TcpConnection.RawData
+	CaptureLimit CaptureLimit
+
+	mutex         sync.Mutex
+	listener      net.Listener
+	connections   map[*TcpConnection]connectionState
+	closedStats   ServerStats             //totals of the connections no longer tracked
+	pool          *handlerPool            //for Handler
+	protocols     map[string]*handlerPool //keyed by ALPN protocol name
+	protocolNames []string                //in the order of registration
+	slots         chan bool               //one entry per open connection when MaxConnections is set
+	rejected      uint64                  //number of connections rejected over the limit
+	handshakes    uint64                  //number of completed TLS handshakes
+	resumed       uint64                  //number of TLS handshakes that resumed a session
+	workers       sync.WaitGroup
+	quit          chan bool
+	closed        bool
+}
+
+func NewServer(h ServerHandler) *Server {
+	return &Server{
+		Handler:     h,
+		connections: make(map[*TcpConnection]connectionState),
+		protocols:   make(map[string]*handlerPool),
+		quit:        make(chan bool),
+	}
+}
+
+//HandleProtocol makes the handlers spawned from h serve the TLS connections that
+//negotiate the ALPN protocol proto; other connections go to Handler.
+//It must be called before the server starts serving. The TLS methods of Server
+//advertise the registered protocols; a listener given to Serve must do so itself.
+func (srv *Server) HandleProtocol(proto string, h ServerHandler) {
+	if _, ok := srv.protocols[proto]; !ok {
+		srv.protocolNames = append(srv.protocolNames, proto)
+	}
+	srv.protocols[proto] = &handlerPool{handler: h}
+}
+
+//the pool for the protocol negotiated on a connection
+func (srv *Server) poolFor(connection *TcpConnection) *handlerPool {
+	if pool, ok := srv.protocols[connection.NegotiatedProtocol()]; ok {
+		return pool
+	}
+	return srv.pool
+}
+
+//advertise the registered protocols, ahead of those already in config
+func (srv *Server) configureTLS(config *tls.Config) *tls.Config {
+	if len(srv.protocolNames) == 0 {
+		return config
+	}
+	config = config.Clone()
+	nextProtos := append([]string(nil), srv.protocolNames...)
+	for _, proto := range config.NextProtos {
+		if _, ok := srv.protocols[proto]; !ok {
+			nextProtos = append(nextProtos, proto)
+		}
+	}
+	config.NextProtos = nextProtos
+	return config
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.closed
+}
+
+//trackConnection records the state of a connection; once the server is closed it
+//returns false instead, and the caller must close the connection
+func (srv *Server) trackConnection(connection *TcpConnection, state connectionState) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.closed {
+		return false
+	}
+	srv.connections[connection] = state
+	return true
+}
+
+func (srv *Server) closeConnection(connection *TcpConnection) {
+	srv.mutex.Lock()
+	_, tracked := srv.connections[connection]
+	if tracked {
+		srv.retireStats(connection)
+	}
+	delete(srv.connections, connection)
+	srv.mutex.Unlock()
+	connection.Close()
+	if tracked {
+		srv.releaseSlot()
+	}
+}
+
+//take a connection slot, waiting for one if the policy says so
+func (srv *Server) acquireSlot() bool {
+	if srv.slots == nil {
+		return true
+	}
+	select {
+	case srv.slots <- true:
+		return true
+	default:
+	}
+	if srv.OverLimitPolicy != WaitOverLimit {
+		return false
+	}
+	var timeout <-chan time.Time
+	if srv.OverLimitWait > 0 {
+		timer := time.NewTimer(srv.OverLimitWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case srv.slots <- true:
+		return true
+	case <-timeout:
+	case <-srv.quit:
+	}
+	return false
+}
+
+func (srv *Server) releaseSlot() {
+	if srv.slots != nil {
+		<-srv.slots
+	}
+}
+
+//turn away a connection over the limit, with the handler's reply if it has one
+func (srv *Server) reject(conn net.Conn) {
+	atomic.AddUint64(&srv.rejected, 1)
+	srv.Handler.Logger().Debug("Server: connection limit reached, rejecting %v", conn.RemoteAddr())
+	rejecter, ok := srv.Handler.(Rejecter)
+	if !ok || srv.OverLimitPolicy == CloseOverLimit {
+		conn.Close()
+		return
+	}
+	go func() {
+		conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		conn.Write(rejecter.RejectResponse())
+		conn.Close()
+	}()
+}
+
+//RejectedConnections returns how many connections were rejected over MaxConnections
+func (srv *Server) RejectedConnections() uint64 {
+	return atomic.LoadUint64(&srv.rejected)
+}
+
+//TLSResumptions returns the number of TLS handshakes, and how many of them resumed a session
+func (srv *Server) TLSResumptions() (handshakes uint64, resumed uint64) {
+	return atomic.LoadUint64(&srv.handshakes), atomic.LoadUint64(&srv.resumed)
+}
+
+//OpenConnections returns the number of connections the server is holding
+func (srv *Server) OpenConnections() int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return len(srv.connections)
+}
+
+//wait in the background for the next request on a connection and only then
+//put it into the queue, so that idle connections do not hold up a handler
+func (srv *Server) awaitRequest(connection *TcpConnection) {
+	if !srv.trackConnection(connection, stateIdle) {
+		srv.closeConnection(connection)
+		return
+	}
+	srv.waitForRequest(connection)
+}
+
+//the part of awaitRequest after the connection is tracked
+func (srv *Server) waitForRequest(connection *TcpConnection) {
+	go func() {
+		if err := connection.WaitForData(); err != nil {
+			if err == ErrorReadTimeout {
+				srv.Handler.Logger().Debug("Server: closing idle connection %v", connection.RemoteAddr())
+			}
+			srv.closeConnection(connection)
+			return
+		}
+		//select picks at random among ready cases, so check for quit first
+		select {
+		case <-srv.quit:
+			srv.closeConnection(connection)
+			return
+		default:
+		}
+		select {
+		case srv.poolFor(connection).connectionQueue <- connection:
+		case <-srv.quit:
+			srv.closeConnection(connection)
+		}
+	}()
+}
+
+//set up a newly accepted connection; the TLS handshake happens here rather than in the accept loop
+func (srv *Server) newConnection(conn net.Conn) {
+	//the handshake is bounded by the header read timeout
+	conn.SetDeadline(deadline(srv.Timeouts.HeaderRead))
+	connection, err := NewTcpConnection(conn)
+	if err != nil {
+		if IsTimeout(err) {
+			srv.Handler.Logger().Notice("Server: TLS handshake timed out: %v", conn.RemoteAddr())
+		}
+		conn.Close()
+		srv.releaseSlot()
+		return
+	}
+	if tlsState := connection.TLSState(); tlsState != nil {
+		atomic.AddUint64(&srv.handshakes, 1)
+		if tlsState.DidResume {
+			atomic.AddUint64(&srv.resumed, 1)
+		}
+	}
+	connection.SetTimeouts(srv.Timeouts)
+	connection.SetCaptureLimit(srv.CaptureLimit)
+	connection.EnableSaveReadData()
+	//a Close either sees the connection or keeps it out, so it cannot be missed
+	if !srv.trackConnection(connection, stateIdle) {
+		connection.Close()
+		srv.releaseSlot()
+		return
+	}
+	srv.waitForRequest(connection)
+}
+
+//call h.Handle, turning a panic into ErrorHandlerPanic so that the handler can go on serving
+func handle(h ServerHandler, connection *TcpConnection) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.Logger().Error("Recovered in server handler %q while handling %v: %v\n%s", h.Tag(), connection.RemoteAddr(), r, debug.Stack())
+			err = ErrorHandlerPanic
+		}
+	}()
+	return h.Handle(connection)
+}
+
+func (srv *Server) handleConnections(pool *handlerPool, h ServerHandler) {
 	logger := h.Logger()
 	defer func() {
 		h.Cleanup()
+		srv.workers.Done()
 		if r := recover(); r != nil {
 			logger.Error("Recovered in server handler %v\n", r)
 		}
 	}()
 
 	for {
-		connection := <-connectionQueue
-		err := h.Handle(connection)
+		var connection *TcpConnection
+		select {
+		case connection = <-pool.connectionQueue:
+		case <-srv.quit:
+			return
+		}
+		if !srv.trackConnection(connection, stateActive) {
+			srv.closeConnection(connection)
+			return
+		}
+		connection.BeginRequest()
+		connection.MarkRawDataBoundary()
+		err := handle(h, connection)
 		if err == ErrorClientCloseConnection {
 			//logger.Info("Server handler is closing connection because the client has closed it: %q", connection.RemoteAddr())
-			connection.Close()
+			srv.closeConnection(connection)
 		} else if err == ErrorServerCloseConnection {
 			//logger.Info("Server handler is closing connection: %q", connection.RemoteAddr())
-			connection.Close()
+			srv.closeConnection(connection)
+		} else if err == ErrorHandlerPanic {
+			//already logged with the stack trace
+			srv.closeConnection(connection)
+		} else if IsTimeout(err) {
+			logger.Notice("Server handler is closing connection %v after a timeout: %v", connection.RemoteAddr(), err)
+			srv.closeConnection(connection)
 		} else if err != nil {
 			logger.Warning("Server handler is closing connection due to error: %v", err)
-			connection.Close()
+			srv.closeConnection(connection)
+		} else if srv.isClosed() {
+			//the server is shutting down; do not wait for another request
+			srv.closeConnection(connection)
 		} else {
-			//put it back into the queue
-			connectionQueue <- connection
+			//keep-alive: hand it back once the next request arrives
+			srv.awaitRequest(connection)
 		}
 	}
 }
 
+func (srv *Server) spawnHandlers(pool *handlerPool) {
+	h := pool.handler
+	//create a queue to share connections that are ready to be read
+	//allow the queue to buffer up to a given number of connections
+	pool.connectionQueue = make(chan *TcpConnection, h.ConnectionQueueLength())
+
+	count := 0
+	for newH, err := h.Spawn(); err == nil; newH, err = h.Spawn() {
+		newServerHandler := newH.(ServerHandler)
+		srv.workers.Add(1)
+		go srv.handleConnections(pool, newServerHandler)
+		count++
+	}
+	h.Logger().Info("Created %d handlers for server: %q", count, h.Tag())
+}
+
 /*
  * Serve accepts incoming connections on the Listener l, creating a
  * new service thread for each.  The service threads read requests and
  * then call connection.Handler to reply to them.
+ * A connection is only queued for the handlers once its next request has
+ * started to arrive, so the number of handlers bounds the requests being
+ * served concurrently rather than the number of open connections.
+ * Serve always returns a non-nil error; after Shutdown or Close it is ErrServerClosed,
+ * otherwise it is the fatal error returned by the listener.
  */
 
-func serve(listener net.Listener, h ServerHandler) error {
+func (srv *Server) Serve(listener net.Listener) error {
 	defer listener.Close()
 
-	logger := h.Logger()
-	connQueueLen := h.ConnectionQueueLength()
+	srv.mutex.Lock()
+	if srv.closed {
+		srv.mutex.Unlock()
+		return ErrServerClosed
+	}
+	srv.listener = listener
+	srv.pool = &handlerPool{handler: srv.Handler}
+	if srv.MaxConnections > 0 {
+		srv.slots = make(chan bool, srv.MaxConnections)
+	}
+	srv.mutex.Unlock()
 
-	//create a queue to share incoming connections
-	//allow the queue to buffer up to a given number of connections 
-	connectionQueue := make(chan *TcpConnection, connQueueLen)
-	count := 0
-	for newH, err := h.Spawn(); err == nil; newH, err = h.Spawn() {
-		newServerHandler := newH.(ServerHandler)
-		go handleConnections(connectionQueue, newServerHandler)
-		count++
+	logger := srv.Handler.Logger()
+
+	srv.spawnHandlers(srv.pool)
+	for _, proto := range srv.protocolNames {
+		srv.spawnHandlers(srv.protocols[proto])
 	}
-	logger.Info("Created %d handlers for server: %q", count, h.Tag())
 
+	var tempDelay time.Duration //how long to sleep on temporary accept failures
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				logger.Error("Server: Accept error: %v", err)
+				//e.g. running out of file descriptors; back off instead of spinning
+				if tempDelay == 0 {
+					tempDelay = minAcceptDelay
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				logger.Error("Server: Accept error: %v; retrying in %v", err, tempDelay)
+				select {
+				case <-time.After(tempDelay):
+				case <-srv.quit:
+					return ErrServerClosed
+				}
 				continue
 			}
 			logger.Critical("Server: fatal error: %v", err)
+			srv.stop()
+			//no one may be left to call Close, e.g. after ListenAndServe
+			srv.closeConnections(stateIdle, false)
+			return err
 		}
-		connection, err := NewTcpConnection(conn)
-		if err != nil {
-			conn.Close()
-		} else {
-			connection.EnableSaveReadData()
-			connectionQueue <- connection
+		tempDelay = 0
+		if !srv.acquireSlot() {
+			srv.reject(conn)
+			continue
 		}
+		go srv.newConnection(conn)
+	}
+}
+
+//serve in the background and report the terminating error to ErrorHandler
+func (srv *Server) serveAsync(listener net.Listener) {
+	go func() {
+		err := srv.Serve(listener)
+		if err != ErrServerClosed && srv.ErrorHandler != nil {
+			srv.ErrorHandler(err)
+		}
+	}()
+}
+
+// Start listens on addr and serves in the background.
+// Errors from listening are returned; a later fatal error is passed to ErrorHandler.
+func (srv *Server) Start(addr string) error {
+	listener, err := listen(addr, false)
+	if err != nil {
+		return err
+	}
+	srv.serveAsync(listener)
+	return nil
+}
+
+func (srv *Server) StartTLS(addr string, certFile string, keyFile string) error {
+	config, err := ServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return srv.StartTLSConfig(addr, config)
+}
+
+//StartTLSConfig is like StartTLS with a config built by the caller, see ServerTLSConfig
+func (srv *Server) StartTLSConfig(addr string, config *tls.Config) error {
+	tlsListener, err := listenTLS(addr, srv.configureTLS(config))
+	if err != nil {
+		return err
 	}
-	panic("should not be reached")
+	srv.serveAsync(tlsListener)
+	return nil
+}
+
+func (srv *Server) ListenAndServe(addr string) error {
+	listener, err := listen(addr, false)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(listener)
+}
+
+func (srv *Server) ListenAndServeTLS(addr string, certFile string, keyFile string) error {
+	config, err := ServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return srv.ListenAndServeTLSConfig(addr, config)
+}
+
+func (srv *Server) ListenAndServeTLSConfig(addr string, config *tls.Config) error {
+	tlsListener, err := listenTLS(addr, srv.configureTLS(config))
+	if err != nil {
+		return err
+	}
+	return srv.Serve(tlsListener)
+}
+
+//stop accepting and tell the handlers to exit once they are done with the current connection
+func (srv *Server) stop() (err error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.closed {
+		return
+	}
+	srv.closed = true
+	close(srv.quit)
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+	return
+}
+
+//close the connections in the given state, or all of them if all is true
+func (srv *Server) closeConnections(state connectionState, all bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for connection, s := range srv.connections {
+		if all || s == state {
+			//close only the socket: a handler may still be reading into the raw data buffer
+			connection.Conn.Close()
+			srv.retireStats(connection)
+			delete(srv.connections, connection)
+			srv.releaseSlot()
+		}
+	}
+}
+
+/*
+ * Shutdown stops the server without interrupting the connections being handled:
+ * it closes the listener and the idle connections, including those waiting in the queue, then waits
+ * for the handlers to finish their in-flight Handle calls and Cleanup.
+ * If ctx expires first, the remaining connections are closed and ctx.Err() is returned.
+ */
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.stop()
+
+	done := make(chan bool)
+	go func() {
+		srv.workers.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		srv.closeConnections(stateIdle, false)
+		select {
+		case <-done:
+			srv.closeConnections(stateIdle, true)
+			return err
+		case <-ctx.Done():
+			srv.closeConnections(stateIdle, true)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes the listener and every connection, including those being handled.
+func (srv *Server) Close() error {
+	err := srv.stop()
+	srv.closeConnections(stateIdle, true)
+	return err
 }
 
 func listen(addr string, ssl bool) (listener net.Listener, err error) {
@@ -123,46 +618,55 @@ func listen(addr string, ssl bool) (listener net.Listener, err error) {
 	return net.Listen("tcp", addr)
 }
 
+func listenTLS(addr string, config *tls.Config) (net.Listener, error) {
+	conn, err := listen(addr, true)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(conn, config), nil
+}
+
+//ListenAndServeErrorHandler, if set, is called with the error that terminated a server
+//started by ListenAndServe, ListenAndServeTLS or ListenAndServeTLSConfig without blocking
+var ListenAndServeErrorHandler func(error)
+
+//ListenAndServe returns the error that terminated the server when blocking;
+//otherwise only listening errors are returned, and a fatal error is logged and
+//passed to ListenAndServeErrorHandler.
 func ListenAndServe(addr string, h ServerHandler, blocking bool) error {
 	listener, err := listen(addr, false)
 	if err != nil {
 		return err
 	}
+	srv := NewServer(h)
+	srv.ErrorHandler = ListenAndServeErrorHandler
 	if blocking {
-		serve(listener, h)
-	} else {
-		go serve(listener, h)
+		return srv.Serve(listener)
 	}
+	srv.serveAsync(listener)
 	return nil
 }
 
 func ListenAndServeTLS(addr string, h ServerHandler, blocking bool, certFile string, keyFile string) error {
-	config := &tls.Config{
-		Rand:       rand.Reader,
-		Time:       time.Now,
-		NextProtos: []string{"http/1.1"},
-	}
-
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	config, err := ServerTLSConfig(certFile, keyFile)
 	if err != nil {
 		return err
 	}
+	return ListenAndServeTLSConfig(addr, h, blocking, config)
+}
 
-	conn, err := listen(addr, true)
+//ListenAndServeTLSConfig is like ListenAndServeTLS with a config built by the caller,
+//e.g. by ServerTLSConfig or GenerateTestTLS
+func ListenAndServeTLSConfig(addr string, h ServerHandler, blocking bool, config *tls.Config) error {
+	tlsListener, err := listenTLS(addr, config)
 	if err != nil {
 		return err
 	}
-	tlsListener := tls.NewListener(conn, config)
-	if err != nil {
-		return err
-	}
-
+	srv := NewServer(h)
+	srv.ErrorHandler = ListenAndServeErrorHandler
 	if blocking {
-		serve(tlsListener, h)
-	} else {
-		go serve(tlsListener, h)
+		return srv.Serve(tlsListener)
 	}
+	srv.serveAsync(tlsListener)
 	return nil
 }
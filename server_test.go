@@ -0,0 +1,551 @@
+package ptcp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"golog"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const TestAddr3 = "localhost:13254"
+
+func startTestServer(addr string, h ServerHandler) *Server {
+	srv := NewServer(h)
+	if err := srv.Start(addr); err != nil {
+		log.Fatalf("failed to listen on %s: %v", addr, err)
+	}
+	return srv
+}
+
+//the bytes of a response that may be nil
+func responseString(response Response) string {
+	if response == nil {
+		return ""
+	}
+	return string(response.Bytes())
+}
+
+type CleanupCountingHandler struct {
+	EchoServerHandler
+	cleanups *int32
+}
+
+func (h *CleanupCountingHandler) Spawn() (interface{}, error) {
+	newH, err := h.EchoServerHandler.Spawn()
+	if err != nil {
+		return nil, err
+	}
+	return &CleanupCountingHandler{EchoServerHandler: *newH.(*EchoServerHandler), cleanups: h.cleanups}, nil
+}
+
+func (h *CleanupCountingHandler) Cleanup() {
+	atomic.AddInt32(h.cleanups, 1)
+}
+
+func TestServerShutdown(t *testing.T) {
+	cleanups := int32(0)
+	listener, err := listen(TestAddr3, false)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewServer(&CleanupCountingHandler{cleanups: &cleanups})
+	served := make(chan error)
+	go func() { served <- srv.Serve(listener) }()
+
+	connection, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+	}
+	defer connection.Close()
+	data := DataStream("")
+	response, err := SendAndReceive(connection, NewEchoClientHandler(), &data)
+	if err != nil || string(response.Bytes()) != DefaultResponse {
+		t.Fatalf("err: %v; received %q", err, responseString(response))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+
+	select {
+	case err = <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Serve returned %v, expected %v", err, ErrServerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return after Shutdown")
+	}
+	if n := atomic.LoadInt32(&cleanups); n != HandlerLimit {
+		t.Errorf("Cleanup called %d times, expected %d", n, HandlerLimit)
+	}
+	if _, err = net.Dial("tcp", TestAddr3); err == nil {
+		t.Errorf("server is still accepting connections after Shutdown")
+	}
+	//the idle keep-alive connection should have been closed
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = connection.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection read returned %v after Shutdown, expected EOF", err)
+	}
+}
+
+func TestServerIdleConnections(t *testing.T) {
+	srv := startTestServer(TestAddr3, &EchoServerHandler{})
+	defer srv.Close()
+	clientHandler := NewEchoClientHandler()
+
+	//open more idle keep-alive connections than there are handlers
+	for i := 0; i < 2*HandlerLimit; i++ {
+		connection, err := Connect(TestAddr3)
+		if err != nil {
+			t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+		}
+		defer connection.Close()
+		data := DataStream("")
+		if _, err = SendAndReceive(connection, clientHandler, &data); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	connection, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(time.Second))
+	data := DataStream("")
+	response, err := SendAndReceive(connection, clientHandler, &data)
+	if err != nil || string(response.Bytes()) != DefaultResponse {
+		t.Errorf("new connection starved by idle ones: err: %v; received %q", err, responseString(response))
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv := startTestServer(TestAddr3, &EchoServerHandler{})
+	connection, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+	}
+	defer connection.Close()
+	//make sure the server has accepted the connection before closing it
+	data := DataStream("")
+	if _, err = SendAndReceive(connection, NewEchoClientHandler(), &data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	srv.Close()
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = connection.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection is still open after Close")
+	}
+}
+
+type temporaryError struct{}
+
+func (e temporaryError) Error() string   { return "temporary accept error" }
+func (e temporaryError) Timeout() bool   { return false }
+func (e temporaryError) Temporary() bool { return true }
+
+var errFatalAccept = errors.New("fatal accept error")
+
+//FailingListener fails Accept with a few temporary errors and then a fatal one
+type FailingListener struct {
+	net.Listener
+	temporary int
+}
+
+func (l *FailingListener) Accept() (net.Conn, error) {
+	if l.temporary > 0 {
+		l.temporary--
+		return nil, temporaryError{}
+	}
+	return nil, errFatalAccept
+}
+
+func TestServerFatalAcceptError(t *testing.T) {
+	listener, err := listen(TestAddr3, false)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	srv := NewServer(&EchoServerHandler{})
+	reported := make(chan error, 1)
+	srv.ErrorHandler = func(err error) { reported <- err }
+	srv.serveAsync(&FailingListener{Listener: listener, temporary: 3})
+
+	select {
+	case err = <-reported:
+		if err != errFatalAccept {
+			t.Errorf("ErrorHandler received %v, expected %v", err, errFatalAccept)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("fatal accept error was not reported")
+	}
+	if err = srv.Serve(listener); err != ErrServerClosed {
+		t.Errorf("Serve on a failed server returned %v, expected %v", err, ErrServerClosed)
+	}
+}
+
+//FailLaterListener accepts connections until fail is set, and then fails fatally
+type FailLaterListener struct {
+	net.Listener
+	fail int32
+}
+
+func (l *FailLaterListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil && atomic.LoadInt32(&l.fail) != 0 {
+		conn.Close()
+		return nil, errFatalAccept
+	}
+	return conn, err
+}
+
+func TestServerFatalAcceptErrorClosesIdle(t *testing.T) {
+	listener, err := listen(TestAddr3, false)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	failing := &FailLaterListener{Listener: listener}
+	srv := NewServer(&EchoServerHandler{})
+	reported := make(chan error, 1)
+	srv.ErrorHandler = func(err error) { reported <- err }
+	srv.serveAsync(failing)
+
+	connection, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+	}
+	defer connection.Close()
+	data := DataStream("")
+	if response, err := SendAndReceive(connection, NewEchoClientHandler(), &data); err != nil || responseString(response) != DefaultResponse {
+		t.Fatalf("err: %v; received %q", err, responseString(response))
+	}
+
+	//the next connection makes Accept fail
+	atomic.StoreInt32(&failing.fail, 1)
+	if conn, err := net.Dial("tcp", TestAddr3); err == nil {
+		conn.Close()
+	}
+	select {
+	case <-reported:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("fatal accept error was not reported")
+	}
+	//the idle keep-alive connection is closed rather than left waiting
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = connection.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection read returned %v after a fatal error, expected %v", err, io.EOF)
+	}
+	if n := srv.OpenConnections(); n != 0 {
+		t.Errorf("%d connections open after a fatal error, expected none", n)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	logger := golog.NewLogger("")
+	logger.AddProcessor("console", golog.NewConsoleProcessor(golog.LOG_INFO, true))
+	srv := NewServer(NewHttpServerHandler(logger, 2, "test_timeout_srv"))
+	srv.Timeouts = Timeouts{HeaderRead: 100 * time.Millisecond, Idle: 100 * time.Millisecond}
+	if err := srv.Start(TestAddr3); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer srv.Close()
+
+	//a client that never finishes its header is disconnected
+	slow, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+	}
+	defer slow.Close()
+	slow.Write([]byte("GET / HTTP/1.1\r\n"))
+	slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = slow.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("slow client read returned %v, expected EOF", err)
+	}
+
+	//an idle keep-alive connection is closed once its next request does not arrive
+	idle, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+	}
+	defer idle.Close()
+	idle.Write([]byte("GET / HTTP/1.1\r\nConnection: keep-alive\r\n\r\n"))
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := ioutil.ReadAll(idle)
+	if err != nil || string(response) != DefaultOKResponse {
+		t.Errorf("idle client read %q, %v; expected %q and EOF", response, err, DefaultOKResponse)
+	}
+}
+
+//PanickingHandler echoes like EchoServerHandler but panics on requests starting with 'P'
+type PanickingHandler struct {
+	EchoServerHandler
+}
+
+func (h *PanickingHandler) Spawn() (interface{}, error) {
+	newH, err := h.EchoServerHandler.Spawn()
+	if err != nil {
+		return nil, err
+	}
+	return &PanickingHandler{EchoServerHandler: *newH.(*EchoServerHandler)}, nil
+}
+
+func (h *PanickingHandler) Handle(connection *TcpConnection) error {
+	first, err := connection.Peek(1)
+	if err != nil {
+		return err
+	}
+	if first[0] == 'P' {
+		panic("bad request")
+	}
+	return h.EchoServerHandler.Handle(connection)
+}
+
+func TestServerHandlerPanic(t *testing.T) {
+	srv := startTestServer(TestAddr3, &PanickingHandler{})
+	defer srv.Close()
+
+	//panic more times than there are handlers
+	for i := 0; i < 2*HandlerLimit; i++ {
+		connection, err := Connect(TestAddr3)
+		if err != nil {
+			t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+		}
+		connection.Write([]byte("Panic"))
+		connection.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = connection.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read after a handler panic returned %v, expected EOF", err)
+		}
+		connection.Close()
+	}
+
+	connection, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(time.Second))
+	data := DataStream("")
+	response, err := SendAndReceive(connection, NewEchoClientHandler(), &data)
+	if err != nil || string(response.Bytes()) != DefaultResponse {
+		t.Errorf("server stopped serving after handler panics: err: %v; received %q", err, responseString(response))
+	}
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	logger := golog.NewLogger("")
+	logger.AddProcessor("console", golog.NewConsoleProcessor(golog.LOG_INFO, true))
+	srv := NewServer(NewHttpServerHandler(logger, 2, "test_limit_srv"))
+	srv.MaxConnections = 2
+	if err := srv.Start(TestAddr3); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer srv.Close()
+
+	for i := 0; i < srv.MaxConnections; i++ {
+		connection, err := Connect(TestAddr3)
+		if err != nil {
+			t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+		}
+		defer connection.Close()
+	}
+
+	rejected, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("error when connecting to %s: %v", TestAddr3, err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := ioutil.ReadAll(rejected)
+	if err != nil || string(response) != DefaultUnavailableResponse {
+		t.Errorf("connection over the limit read %q, %v; expected %q", response, err, DefaultUnavailableResponse)
+	}
+	if n := srv.RejectedConnections(); n != 1 {
+		t.Errorf("%d connections rejected, expected 1", n)
+	}
+	if n := srv.OpenConnections(); n != srv.MaxConnections {
+		t.Errorf("%d connections open, expected %d", n, srv.MaxConnections)
+	}
+}
+
+//ReplyHandler answers each request with what reply returns for the connection
+type ReplyHandler struct {
+	EchoServerHandler
+	reply func(*TcpConnection) string
+}
+
+func (h *ReplyHandler) Spawn() (interface{}, error) {
+	newH, err := h.EchoServerHandler.Spawn()
+	if err != nil {
+		return nil, err
+	}
+	return &ReplyHandler{EchoServerHandler: *newH.(*EchoServerHandler), reply: h.reply}, nil
+}
+
+func (h *ReplyHandler) Handle(connection *TcpConnection) (err error) {
+	if _, err = connection.Read(h.buffer); err != nil {
+		return
+	}
+	_, err = connection.Write([]byte(h.reply(connection)))
+	return
+}
+
+//send a request on a new TLS connection and return the reply
+func exchangeTLS(addr string, config *tls.Config) (string, *TcpConnection, error) {
+	connection, err := ConnectTLSConfig(addr, config)
+	if err != nil {
+		return "", nil, err
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(time.Second))
+	data := DataStream("")
+	response, err := SendAndReceive(connection, NewEchoClientHandler(), &data)
+	return responseString(response), connection, err
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca, err := NewTestCA()
+	if err != nil {
+		t.Fatalf("failed to create the CA: %v", err)
+	}
+	serverConfig, err := ca.ServerTLSConfig("localhost")
+	if err != nil {
+		t.Fatalf("failed to issue the server certificate: %v", err)
+	}
+	SetClientAuth(serverConfig, tls.RequireAndVerifyClientCert)
+	srv := NewServer(&ReplyHandler{reply: func(connection *TcpConnection) string {
+		identity := connection.PeerIdentity()
+		if identity == nil || !identity.Verified {
+			return "anonymous"
+		}
+		return identity.Subject.CommonName
+	}})
+	if err = srv.StartTLSConfig(TestAddr3, serverConfig); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer srv.Close()
+
+	clientConfig, err := ca.ClientTLSConfig("client.example.com")
+	if err != nil {
+		t.Fatalf("failed to issue the client certificate: %v", err)
+	}
+	if reply, _, err := exchangeTLS(TestAddr3, clientConfig); err != nil || reply != "client.example.com" {
+		t.Errorf("client with a certificate got %q, %v; expected its common name", reply, err)
+	}
+	if reply, _, err := exchangeTLS(TestAddr3, &tls.Config{RootCAs: ca.CertPool()}); err == nil {
+		t.Errorf("client without a certificate got %q, expected an error", reply)
+	}
+}
+
+func TestServerALPN(t *testing.T) {
+	serverConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	srv := NewServer(&EchoServerHandler{})
+	srv.HandleProtocol("ptcp-test", &ReplyHandler{reply: func(connection *TcpConnection) string {
+		return connection.NegotiatedProtocol()
+	}})
+	if err = srv.StartTLSConfig(TestAddr3, serverConfig); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer srv.Close()
+
+	cases := map[string]string{"ptcp-test": "ptcp-test", "http/1.1": DefaultResponse, "": DefaultResponse}
+	for proto, expected := range cases {
+		config := clientConfig.Clone()
+		if proto != "" {
+			config.NextProtos = []string{proto}
+		}
+		if reply, _, err := exchangeTLS(TestAddr3, config); err != nil || reply != expected {
+			t.Errorf("protocol %q: got %q, %v; expected %q", proto, reply, err, expected)
+		}
+	}
+}
+
+func TestServerSessionResumption(t *testing.T) {
+	serverConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	rotator, err := NewTicketKeyRotator(2)
+	if err != nil {
+		t.Fatalf("failed to create ticket keys: %v", err)
+	}
+	rotator.Attach(serverConfig)
+	srv := NewServer(&EchoServerHandler{})
+	if err = srv.StartTLSConfig(TestAddr3, serverConfig); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer srv.Close()
+
+	cache := NewClientSessionCache(8)
+	clientConfig.ClientSessionCache = cache
+	resumed := []bool{}
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			//tickets issued with the previous key are still accepted
+			rotator.Rotate()
+		}
+		_, connection, err := exchangeTLS(TestAddr3, clientConfig)
+		if err != nil {
+			t.Fatalf("exchange %d failed: %v", i, err)
+		}
+		resumed = append(resumed, connection.TLSState().DidResume)
+	}
+	if resumed[0] || !resumed[1] || !resumed[2] || !resumed[3] {
+		t.Errorf("sessions resumed: %v, expected all but the first", resumed)
+	}
+	if hits, misses := cache.Stats(); hits != 3 || misses != 1 {
+		t.Errorf("client cache hits/misses: %d/%d, expected 3/1", hits, misses)
+	}
+	//the server counts the handshake after the client has finished it
+	time.Sleep(50 * time.Millisecond)
+	if handshakes, resumptions := srv.TLSResumptions(); handshakes != 4 || resumptions != 3 {
+		t.Errorf("server handshakes/resumptions: %d/%d, expected 4/3", handshakes, resumptions)
+	}
+}
+
+func TestConnectTLSResumption(t *testing.T) {
+	serverConfig, _, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	srv := NewServer(&EchoServerHandler{})
+	if err = srv.StartTLSConfig(TestAddr3, serverConfig); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer srv.Close()
+
+	hits, _ := DefaultClientSessionCache.Stats()
+	resumed := []bool{}
+	for i := 0; i < 2; i++ {
+		connection, err := ConnectTLS(TestAddr3, "localhost", false)
+		if err != nil {
+			t.Fatalf("connection %d failed: %v", i, err)
+		}
+		//the session ticket arrives with the reply
+		data := DataStream("")
+		if _, err = SendAndReceive(connection, NewEchoClientHandler(), &data); err != nil {
+			t.Fatalf("exchange %d failed: %v", i, err)
+		}
+		resumed = append(resumed, connection.TLSState().DidResume)
+		connection.Close()
+	}
+	if !resumed[1] {
+		t.Errorf("sessions resumed: %v, expected the second one", resumed)
+	}
+	if after, _ := DefaultClientSessionCache.Stats(); after < hits+1 {
+		t.Errorf("DefaultClientSessionCache had no session to offer")
+	}
+}
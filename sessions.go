@@ -0,0 +1,213 @@
+/*
+ * TLS session resumption: rotating session ticket keys for servers and a
+ * counting session cache for clients.
+ */
+
+package ptcp
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"golog"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//TicketKeyLength is the size of one session ticket key
+const TicketKeyLength = 32
+
+//DefaultMaxTicketKeys is how many keys a rotator keeps: the newest encrypts new
+//tickets, and all of them are tried on tickets presented by clients
+const DefaultMaxTicketKeys = 3
+
+//DefaultTicketKeyInterval is how often Start updates the keys when no interval is given
+const DefaultTicketKeyInterval = 24 * time.Hour
+
+var ErrorInvalidTicketKeyFile = errors.New("Ticket key file must hold a whole number of 32 byte keys")
+
+// TicketKeyRotator supplies the session ticket keys of server configs. The keys
+// are either generated and rotated in memory, or loaded from a file shared by
+// several servers so that a ticket issued by one is accepted by the others.
+type TicketKeyRotator struct {
+	MaxKeys int
+
+	mutex   sync.Mutex
+	keyFile string
+	keys    [][TicketKeyLength]byte //newest first
+	tickets *tls.Config             //holds the keys; encrypts and decrypts the tickets
+}
+
+func NewTicketKeyRotator(maxKeys int) (*TicketKeyRotator, error) {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxTicketKeys
+	}
+	r := &TicketKeyRotator{MaxKeys: maxKeys, tickets: &tls.Config{}}
+	if err := r.Rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//LoadTicketKeyRotator reads the keys from keyFile, which holds raw 32 byte keys, newest first.
+//MaxKeys is the number of keys in the file, or DefaultMaxTicketKeys if that is larger.
+func LoadTicketKeyRotator(keyFile string) (*TicketKeyRotator, error) {
+	r := &TicketKeyRotator{MaxKeys: DefaultMaxTicketKeys, keyFile: keyFile, tickets: &tls.Config{}}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	if len(r.keys) > r.MaxKeys {
+		r.MaxKeys = len(r.keys)
+	}
+	return r, nil
+}
+
+//must hold the mutex
+func (r *TicketKeyRotator) setKeys(keys [][TicketKeyLength]byte) {
+	r.keys = keys
+	r.tickets.SetSessionTicketKeys(keys)
+}
+
+//Rotate generates a new key for new tickets; the oldest key beyond MaxKeys is dropped.
+//A MaxKeys of zero means DefaultMaxTicketKeys.
+func (r *TicketKeyRotator) Rotate() error {
+	var key [TicketKeyLength]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	maxKeys := r.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxTicketKeys
+	}
+	keys := append([][TicketKeyLength]byte{key}, r.keys...)
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+	}
+	r.setKeys(keys)
+	return nil
+}
+
+//Reload reads the key file again
+func (r *TicketKeyRotator) Reload() error {
+	data, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 || len(data)%TicketKeyLength != 0 {
+		return ErrorInvalidTicketKeyFile
+	}
+	keys := make([][TicketKeyLength]byte, len(data)/TicketKeyLength)
+	for i := range keys {
+		copy(keys[i][:], data[i*TicketKeyLength:])
+	}
+	r.mutex.Lock()
+	r.setKeys(keys)
+	r.mutex.Unlock()
+	return nil
+}
+
+/*
+ * Start rotates the keys every interval, or reloads them from the key file if
+ * the rotator was loaded from one; if interval is not positive, every
+ * DefaultTicketKeyInterval. Failures are logged and the current keys stay in
+ * use. Call the returned function to stop; it returns once no update is in
+ * progress.
+ */
+func (r *TicketKeyRotator) Start(interval time.Duration, logger *golog.Logger) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultTicketKeyInterval
+	}
+	ticker := time.NewTicker(interval)
+	quit := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-quit:
+				return
+			}
+			var err error
+			if r.keyFile != "" {
+				err = r.Reload()
+			} else {
+				err = r.Rotate()
+			}
+			if err != nil {
+				logger.Error("Failed to update session ticket keys: %v", err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+		<-done
+	}
+}
+
+//Attach makes a server config issue and accept tickets with the rotator's keys.
+//It keeps working on clones of config, such as those made by Server.
+func (r *TicketKeyRotator) Attach(config *tls.Config) {
+	config.SessionTicketsDisabled = false
+	config.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		return r.tickets.EncryptTicket(cs, ss)
+	}
+	config.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		return r.tickets.DecryptTicket(identity, cs)
+	}
+}
+
+// ClientSessionCache lets ConnectTLSConfig resume sessions with servers it
+// has connected to before, and counts how often it had a session to offer.
+// Set it as the ClientSessionCache of the client config.
+type ClientSessionCache struct {
+	cache  tls.ClientSessionCache
+	hits   uint64
+	misses uint64
+}
+
+//NewClientSessionCache keeps the sessions of up to capacity servers
+func NewClientSessionCache(capacity int) *ClientSessionCache {
+	return &ClientSessionCache{cache: tls.NewLRUClientSessionCache(capacity)}
+}
+
+//DefaultClientSessionCacheSize is the number of servers DefaultClientSessionCache keeps sessions for
+const DefaultClientSessionCacheSize = 64
+
+//DefaultClientSessionCache is shared by the connections made with ConnectTLS, so that
+//repeated connections to a server resume their session
+var DefaultClientSessionCache = NewClientSessionCache(DefaultClientSessionCacheSize)
+
+func (c *ClientSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	session, ok := c.cache.Get(sessionKey)
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return session, ok
+}
+
+func (c *ClientSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.cache.Put(sessionKey, cs)
+}
+
+//Stats returns how many handshakes found a session to offer, and how many did not
+func (c *ClientSessionCache) Stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+//HitRate is the fraction of handshakes that found a session to offer
+func (c *ClientSessionCache) HitRate() float64 {
+	hits, misses := c.Stats()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,46 @@
+package ptcp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTicketKeyRotatorLoadAndRotate(t *testing.T) {
+	file, err := ioutil.TempFile("", "ptcp-ticket-keys")
+	if err != nil {
+		t.Fatalf("failed to create a key file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	keys := bytes.Repeat([]byte{1}, TicketKeyLength)
+	keys = append(keys, bytes.Repeat([]byte{2}, TicketKeyLength)...)
+	file.Write(keys)
+	file.Close()
+
+	r, err := LoadTicketKeyRotator(file.Name())
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", file.Name(), err)
+	}
+	if r.MaxKeys != DefaultMaxTicketKeys {
+		t.Errorf("MaxKeys is %d, expected %d", r.MaxKeys, DefaultMaxTicketKeys)
+	}
+	for i := 0; i < 2; i++ {
+		if err = r.Rotate(); err != nil {
+			t.Fatalf("failed to rotate: %v", err)
+		}
+	}
+	//the loaded keys move down and the oldest one is dropped
+	if len(r.keys) != DefaultMaxTicketKeys || r.keys[2][0] != 1 {
+		t.Errorf("got %d keys after rotating, the oldest starting with %d", len(r.keys), r.keys[len(r.keys)-1][0])
+	}
+
+	//a zero MaxKeys keeps the default number of keys rather than none
+	r.MaxKeys = 0
+	if err = r.Rotate(); err != nil || len(r.keys) != DefaultMaxTicketKeys {
+		t.Errorf("got %d keys, %v with a zero MaxKeys", len(r.keys), err)
+	}
+
+	stop := r.Start(0, newTestLogger())
+	stop()
+}
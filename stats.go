@@ -0,0 +1,141 @@
+/*
+ * Byte and timing statistics of connections, and their totals for a server.
+ */
+
+package ptcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//ConnectionStats is a snapshot of the statistics of a connection
+type ConnectionStats struct {
+	BytesRead    int64 //including data read ahead and not consumed yet; after decryption for TLS
+	BytesWritten int64
+	Reads        int64 //reads from the socket
+	Writes       int64
+	Requests     int64 //served by a Server, or sent with SendAndReceive
+	Opened       time.Time
+	ConnectTime  time.Duration //dialing the connection, for client connections
+	TLSHandshake time.Duration //zero for plain connections
+	FirstByte    time.Time     //when data first arrived; zero if none has
+	LastActivity time.Time     //of the last read or write
+}
+
+//connectionStats are updated by the goroutine using the connection and read by others;
+//the times are in nanoseconds since the Unix epoch
+type connectionStats struct {
+	bytesRead    int64
+	bytesWritten int64
+	reads        int64
+	writes       int64
+	requests     int64
+	opened       int64
+	connectTime  int64
+	tlsHandshake int64
+	firstByte    int64
+	lastActivity int64
+}
+
+func newConnectionStats() *connectionStats {
+	return &connectionStats{opened: time.Now().UnixNano()}
+}
+
+//dialed records how a client connection was set up: opened is when dialing started
+func (stats *connectionStats) dialed(opened time.Time, connectTime time.Duration, tlsHandshake time.Duration) {
+	atomic.StoreInt64(&stats.opened, opened.UnixNano())
+	atomic.StoreInt64(&stats.connectTime, int64(connectTime))
+	atomic.StoreInt64(&stats.tlsHandshake, int64(tlsHandshake))
+}
+
+func (stats *connectionStats) read(n int) {
+	now := time.Now().UnixNano()
+	atomic.AddInt64(&stats.reads, 1)
+	if n > 0 {
+		atomic.AddInt64(&stats.bytesRead, int64(n))
+		atomic.CompareAndSwapInt64(&stats.firstByte, 0, now)
+	}
+	atomic.StoreInt64(&stats.lastActivity, now)
+}
+
+func (stats *connectionStats) wrote(n int) {
+	atomic.AddInt64(&stats.writes, 1)
+	atomic.AddInt64(&stats.bytesWritten, int64(n))
+	atomic.StoreInt64(&stats.lastActivity, time.Now().UnixNano())
+}
+
+//the time of a stats field; zero stays the zero time
+func statsTime(nanoseconds int64) time.Time {
+	if nanoseconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanoseconds)
+}
+
+func (stats *connectionStats) snapshot() ConnectionStats {
+	return ConnectionStats{
+		BytesRead:    atomic.LoadInt64(&stats.bytesRead),
+		BytesWritten: atomic.LoadInt64(&stats.bytesWritten),
+		Reads:        atomic.LoadInt64(&stats.reads),
+		Writes:       atomic.LoadInt64(&stats.writes),
+		Requests:     atomic.LoadInt64(&stats.requests),
+		Opened:       statsTime(atomic.LoadInt64(&stats.opened)),
+		ConnectTime:  time.Duration(atomic.LoadInt64(&stats.connectTime)),
+		TLSHandshake: time.Duration(atomic.LoadInt64(&stats.tlsHandshake)),
+		FirstByte:    statsTime(atomic.LoadInt64(&stats.firstByte)),
+		LastActivity: statsTime(atomic.LoadInt64(&stats.lastActivity)),
+	}
+}
+
+//liveStats returns the statistics NewTcpConnection set up, creating them on first use
+//for a TcpConnection made otherwise; Opened is then the time of that use
+func (connection *TcpConnection) liveStats() *connectionStats {
+	connection.statsSet.Do(func() {
+		if connection.stats == nil {
+			connection.stats = newConnectionStats()
+		}
+	})
+	return connection.stats
+}
+
+//Stats returns the statistics of the connection so far; it may be called from any goroutine
+func (connection *TcpConnection) Stats() ConnectionStats {
+	return connection.liveStats().snapshot()
+}
+
+//ServerStats are the totals over the connections a Server accepted
+type ServerStats struct {
+	Connections  int64 //accepted, including the open ones
+	Open         int64
+	Requests     int64
+	BytesRead    int64
+	BytesWritten int64
+	TLSHandshake time.Duration //spent on all the handshakes
+}
+
+func (total *ServerStats) add(stats ConnectionStats) {
+	total.Requests += stats.Requests
+	total.BytesRead += stats.BytesRead
+	total.BytesWritten += stats.BytesWritten
+	total.TLSHandshake += stats.TLSHandshake
+}
+
+//Stats returns the totals over the connections closed so far and those still open
+func (srv *Server) Stats() ServerStats {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	total := srv.closedStats
+	for connection := range srv.connections {
+		total.add(connection.Stats())
+		total.Open++
+	}
+	total.Connections = int64(len(srv.connections)) + srv.closedStats.Connections
+	return total
+}
+
+//must hold the mutex; connection no longer counts as open
+func (srv *Server) retireStats(connection *TcpConnection) {
+	srv.closedStats.add(connection.Stats())
+	srv.closedStats.Connections++
+}
@@ -10,95 +10,389 @@
 package ptcp
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
-	"io"
 	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // TcpConnection is a thin wrapper around TCP socket connection
 type TcpConnection struct {
 	tlsState *tls.ConnectionState //TLS state info
-	rawData  *bytes.Buffer        //save the rawData as we parse it
+	rawData  *capture             //save the rawData of the current message as we parse it
+	written  *capture             //the data written since the start of the current message
+	tee      *tee                 //copy of the traffic, nil if none
+	limit    CaptureLimit         //applied to each message captured
+	reader   *bufio.Reader        //reads ahead of the handlers; kept for the life of the connection
+	timeouts *Timeouts            //deadlines applied to each request, nil if none
+	stats    *connectionStats     //see Stats and liveStats
+	statsSet sync.Once            //creates stats once for a connection not made by NewTcpConnection
 	net.Conn                      //socket connection
 }
 
-//InitialBufferLength is the size of buffer allocated initially.
-//The buffer can be expanded if needed
-//The initial length should not be too big or small
+//socketReader feeds the buffered reader of a connection from its socket
+type socketReader struct {
+	connection *TcpConnection
+}
+
+func (r socketReader) Read(data []byte) (n int, err error) {
+	connection := r.connection
+	n, err = connection.Conn.Read(data) //calling the underlying socket's Read
+	if err != nil && IsTimeout(err) {
+		err = ErrorReadTimeout
+	}
+	connection.liveStats().read(n)
+	if n > 0 && connection.rawData != nil {
+		connection.rawData.write(data[:n])
+	}
+	if n > 0 && connection.tee != nil {
+		connection.tee.write(TeeRead, data[:n])
+	}
+	return n, err
+}
+
+//Timeouts bound how long each stage of a request may take on a connection.
+//A zero duration means no limit.
+type Timeouts struct {
+	HeaderRead time.Duration //from the start of a request (or the TLS handshake) until the body is read
+	BodyRead   time.Duration //reading the body, once BeginBody is called
+	Write      time.Duration //writing the response, from the start of the request
+	Idle       time.Duration //waiting for the next request on a keep-alive connection
+}
+
+//InitialBufferLength was the size of the buffer allocated initially for the data read.
+//
+//Deprecated: nothing uses it, captured data grows as it is read (see CaptureLimit);
+//it is kept for compatibility only.
 const InitialBufferLength = 64 * 1024 //64K bytes
 
+//ReadBufferLength is the size of the buffer a connection reads ahead into
+const ReadBufferLength = 4 * 1024 //4K bytes
+
 var (
 	//Handshake failure
 	ErrorTLSHandshake = errors.New("Handshake Failed")
-	ErrorReadTimeout  = errors.New("Invalid Read Timeout")
-	ErrorWriteTimeout = errors.New("Invalid Write Timeout")
+	ErrorReadTimeout  = errors.New("Read Timeout")
+	ErrorWriteTimeout = errors.New("Write Timeout")
+	//STARTTLS failures
+	ErrorTLSAlreadyStarted = errors.New("TLS already started")
+	ErrorDataBeforeTLS     = errors.New("Unexpected data received before the TLS handshake")
 )
 
 //Wrap a tcp connection into a TcpConnection object
 //
 func NewTcpConnection(conn net.Conn) (connection *TcpConnection, err error) {
+	stats := newConnectionStats()
 	if tlsConn, ok := conn.(*tls.Conn); ok {
+		start := time.Now()
 		err = tlsConn.Handshake()
 		if err != nil {
 			return
 		}
+		stats.tlsHandshake = int64(time.Since(start))
 		tlsState := new(tls.ConnectionState)
 		*tlsState = tlsConn.ConnectionState()
 		if tlsState.HandshakeComplete {
-			connection = &TcpConnection{Conn: conn, rawData: nil, tlsState: tlsState}
+			connection = &TcpConnection{Conn: conn, rawData: nil, tlsState: tlsState, stats: stats}
 		} else {
 			err = ErrorTLSHandshake
 		}
 	} else {
-		connection = &TcpConnection{Conn: conn, rawData: nil}
+		connection = &TcpConnection{Conn: conn, rawData: nil, stats: stats}
 	}
 	return
 }
 
+//PeerIdentity describes the certificate presented by the other end of a TLS connection
+type PeerIdentity struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	Verified       bool                //the certificate chains up to a trusted CA
+	Chain          []*x509.Certificate //the verified chain, or the certificates as presented if not verified
+}
+
+//TLSState returns the state of the TLS handshake, or nil for a plain connection
+func (connection *TcpConnection) TLSState() *tls.ConnectionState {
+	return connection.tlsState
+}
+
+//StartTLSClient upgrades a plain connection to TLS as the client, for protocols
+//that switch to TLS mid-stream (STARTTLS). If config has no ServerName, the remote
+//address is used. Data captured by EnableSaveReadData is kept, and from now on
+//the decrypted data is captured. The connection must be closed if it fails.
+func (connection *TcpConnection) StartTLSClient(config *tls.Config) error {
+	addr := connection.RemoteAddr().String()
+	err := connection.startTLS(tls.Client(connection.Conn, withServerName(config, addr)))
+	if err != nil && err != ErrorTLSAlreadyStarted && err != ErrorDataBeforeTLS {
+		err = newTLSError(addr, err)
+	}
+	return err
+}
+
+//StartTLSServer upgrades a plain connection to TLS as the server, see StartTLSClient
+func (connection *TcpConnection) StartTLSServer(config *tls.Config) error {
+	return connection.startTLS(tls.Server(connection.Conn, config))
+}
+
+func (connection *TcpConnection) startTLS(tlsConn *tls.Conn) error {
+	if connection.tlsState != nil {
+		return ErrorTLSAlreadyStarted
+	}
+	//anything received ahead of the handshake was sent in the clear and
+	//must not be mistaken for protected data
+	if connection.Buffered() > 0 {
+		return ErrorDataBeforeTLS
+	}
+	start := time.Now()
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&connection.liveStats().tlsHandshake, int64(time.Since(start)))
+	tlsState := tlsConn.ConnectionState()
+	connection.Conn = tlsConn
+	connection.tlsState = &tlsState
+	return nil
+}
+
+//NegotiatedProtocol returns the protocol agreed on by ALPN during the TLS handshake, if any
+func (connection *TcpConnection) NegotiatedProtocol() string {
+	if connection.tlsState == nil {
+		return ""
+	}
+	return connection.tlsState.NegotiatedProtocol
+}
+
+//PeerCertificates returns the certificates presented by the peer, leaf first
+func (connection *TcpConnection) PeerCertificates() []*x509.Certificate {
+	if connection.tlsState == nil {
+		return nil
+	}
+	return connection.tlsState.PeerCertificates
+}
+
+//PeerIdentity returns the identity in the peer's certificate, or nil if it did not present one
+func (connection *TcpConnection) PeerIdentity() *PeerIdentity {
+	certs := connection.PeerCertificates()
+	if len(certs) == 0 {
+		return nil
+	}
+	leaf := certs[0]
+	identity := &PeerIdentity{
+		Subject:        leaf.Subject,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+		Chain:          certs,
+	}
+	if chains := connection.tlsState.VerifiedChains; len(chains) > 0 {
+		identity.Verified = true
+		identity.Chain = chains[0]
+	}
+	return identity
+}
+
 func (connection *TcpConnection) EnableSaveReadData() {
 	if connection.rawData == nil {
-		buffer := make([]byte, 0, InitialBufferLength)
-		connection.rawData = bytes.NewBuffer(buffer)
+		connection.startCapture()
+	}
+}
+
+//start capturing a new message; data read ahead is part of it once it is consumed
+func (connection *TcpConnection) startCapture() {
+	connection.rawData = newCapture(connection.limit)
+	if buffered := connection.Buffered(); buffered > 0 {
+		ahead, _ := connection.reader.Peek(buffered)
+		connection.rawData.write(ahead)
+	}
+}
+
+//SetCaptureLimit bounds the data captured per message, from the next message on
+//(see MarkRawDataBoundary) or when EnableSaveReadData starts capturing
+func (connection *TcpConnection) SetCaptureLimit(limit CaptureLimit) {
+	connection.limit = limit
+}
+
+//CaptureOverflowed reports whether the current message was larger than the capture limit,
+//so that RawData does not return all of it
+func (connection *TcpConnection) CaptureOverflowed() bool {
+	return connection.rawData != nil && connection.rawData.overflowed(connection.Buffered())
+}
+
+//MarkRawDataBoundary starts a new message: RawData returns only what is consumed from now on,
+//and WrittenData only what is written. The data they returned before stays valid.
+func (connection *TcpConnection) MarkRawDataBoundary() {
+	if connection.rawData != nil {
+		connection.startCapture()
+	}
+	if connection.written != nil {
+		connection.written = newCapture(connection.limit)
+	}
+}
+
+//EnableSaveWrittenData captures the data written, subject to the capture limit like RawData
+func (connection *TcpConnection) EnableSaveWrittenData() {
+	if connection.written == nil {
+		connection.written = newCapture(connection.limit)
 	}
 }
 
+func (connection *TcpConnection) DisableSaveWrittenData() {
+	connection.written = nil
+}
+
+//WrittenData returns the data written since the start of the current message, see MarkRawDataBoundary
+func (connection *TcpConnection) WrittenData() []byte {
+	if connection.written != nil {
+		return connection.written.bytes(0)
+	}
+	return nil
+}
+
+//WrittenDataOverflowed reports whether more was written than the capture limit lets WrittenData return
+func (connection *TcpConnection) WrittenDataOverflowed() bool {
+	return connection.written != nil && connection.written.overflowed(0)
+}
+
 func (connection *TcpConnection) DisableSaveReadData() {
 	connection.rawData = nil
 }
 
+//IsTimeout reports whether err is caused by a connection deadline
+func IsTimeout(err error) bool {
+	if err == ErrorReadTimeout || err == ErrorWriteTimeout {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+//deadline returns the time a stage of the given duration must finish by; zero means none
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+//SetTimeouts makes the connection enforce the given timeouts from now on
+func (connection *TcpConnection) SetTimeouts(timeouts Timeouts) {
+	connection.timeouts = &timeouts
+}
+
+//BeginRequest arms the header read and write deadlines for a new request, and counts it
+func (connection *TcpConnection) BeginRequest() {
+	atomic.AddInt64(&connection.liveStats().requests, 1)
+	if connection.timeouts == nil {
+		return
+	}
+	connection.Conn.SetReadDeadline(deadline(connection.timeouts.HeaderRead))
+	connection.Conn.SetWriteDeadline(deadline(connection.timeouts.Write))
+}
+
+//BeginBody replaces the header read deadline with the body read deadline.
+//Handlers call it once they have parsed the header of a request.
+func (connection *TcpConnection) BeginBody() {
+	if connection.timeouts == nil {
+		return
+	}
+	connection.Conn.SetReadDeadline(deadline(connection.timeouts.BodyRead))
+}
+
+//Reader returns the buffered reader of the connection, e.g. for http.ReadRequest.
+//It is kept across requests, so data read ahead of one request is not lost.
+func (connection *TcpConnection) Reader() *bufio.Reader {
+	if connection.reader == nil {
+		connection.reader = bufio.NewReaderSize(socketReader{connection}, ReadBufferLength)
+	}
+	return connection.reader
+}
+
+//Buffered returns the number of bytes read from the socket but not yet consumed
+func (connection *TcpConnection) Buffered() int {
+	if connection.reader == nil {
+		return 0
+	}
+	return connection.reader.Buffered()
+}
+
+//Peek returns the next n bytes without consuming them, see bufio.Reader.Peek
+func (connection *TcpConnection) Peek(n int) ([]byte, error) {
+	return connection.Reader().Peek(n)
+}
+
+//ReadSlice consumes data up to and including delim, see bufio.Reader.ReadSlice
+func (connection *TcpConnection) ReadSlice(delim byte) ([]byte, error) {
+	return connection.Reader().ReadSlice(delim)
+}
+
+//WaitForData blocks until there is data to Read on the connection.
+//The data is kept for the next Read, so nothing is consumed.
+//If the connection has an idle timeout, WaitForData gives up after it.
+func (connection *TcpConnection) WaitForData() error {
+	if connection.Buffered() > 0 {
+		return nil
+	}
+	if connection.timeouts != nil {
+		connection.Conn.SetReadDeadline(deadline(connection.timeouts.Idle))
+	}
+	_, err := connection.Peek(1)
+	return err
+}
+
 func (connection *TcpConnection) Read(data []byte) (n int, err error) {
-	n, err = connection.Conn.Read(data) //calling the underlying socket's Read
-	if (err == nil || err == io.EOF) && n > 0 && connection.rawData != nil {
-		nn, err1 := connection.rawData.Write(data[:n])
-		if err1 != nil {
-			connection.rawData.Reset()
-		}
-		if nn != n {
-			connection.rawData.Reset()
-		}
+	return connection.Reader().Read(data)
+}
+
+//BytesRead returns the number of bytes consumed from the connection so far
+func (connection *TcpConnection) BytesRead() int64 {
+	return atomic.LoadInt64(&connection.liveStats().bytesRead) - int64(connection.Buffered())
+}
+
+func (connection *TcpConnection) Write(data []byte) (n int, err error) {
+	n, err = connection.Conn.Write(data)
+	if err != nil && IsTimeout(err) {
+		err = ErrorWriteTimeout
 	}
-	return n, err
+	connection.liveStats().wrote(n)
+	if n > 0 && connection.written != nil {
+		connection.written.write(data[:n])
+	}
+	if n > 0 && connection.tee != nil {
+		connection.tee.write(TeeWrite, data[:n])
+	}
+	return
 }
 
 func (connection *TcpConnection) Close() error {
 	if connection.rawData != nil {
-		connection.rawData.Reset()
+		connection.rawData.reset()
+	}
+	if connection.written != nil {
+		connection.written.reset()
 	}
 	return connection.Conn.Close()
 }
 
+//Reset drops the captured data that has been consumed, see MarkRawDataBoundary
 func (connection *TcpConnection) Reset() error {
-	if connection.rawData != nil {
-		connection.rawData.Reset()
-	}
+	connection.MarkRawDataBoundary()
 	return nil
 }
 
+//RawData returns the data of the current message consumed so far, as the capture limit allows
 func (connection *TcpConnection) RawData() (data []byte) {
 	if connection.rawData != nil {
-		return connection.rawData.Bytes()
+		return connection.rawData.bytes(connection.Buffered())
 	}
 	return nil
 }
@@ -0,0 +1,340 @@
+package ptcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartTLS(t *testing.T) {
+	serverConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	//a server that switches to TLS on request, like SMTP
+	serverDone := make(chan error, 1)
+	var captured []byte
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		serverConnection, _ := NewTcpConnection(conn)
+		defer serverConnection.Close()
+		serverConnection.EnableSaveReadData()
+		buffer := make([]byte, 100)
+		if _, err = serverConnection.Read(buffer); err != nil {
+			serverDone <- err
+			return
+		}
+		serverConnection.Write([]byte("OK"))
+		if err = serverConnection.StartTLSServer(serverConfig); err != nil {
+			serverDone <- err
+			return
+		}
+		if _, err = serverConnection.Read(buffer); err != nil {
+			serverDone <- err
+			return
+		}
+		captured = append(captured, serverConnection.RawData()...)
+		_, err = serverConnection.Write(DefaultResponseBytes)
+		serverDone <- err
+	}()
+
+	connection, err := Connect(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(2 * time.Second))
+	connection.Write([]byte("STARTTLS"))
+	buffer := make([]byte, 100)
+	if n, err := connection.Read(buffer); err != nil || string(buffer[:n]) != "OK" {
+		t.Fatalf("STARTTLS got %q, %v", buffer[:n], err)
+	}
+	config := clientConfig.Clone()
+	config.ServerName = "localhost"
+	if err = connection.StartTLSClient(config); err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	if connection.TLSState() == nil {
+		t.Errorf("no TLS state after StartTLSClient")
+	}
+	if err = connection.StartTLSClient(config); err != ErrorTLSAlreadyStarted {
+		t.Errorf("second StartTLSClient returned %v, expected %v", err, ErrorTLSAlreadyStarted)
+	}
+	data := DataStream("")
+	response, err := SendAndReceive(connection, NewEchoClientHandler(), &data)
+	if err != nil || responseString(response) != DefaultResponse {
+		t.Errorf("exchange over TLS got %q, %v", responseString(response), err)
+	}
+
+	if err = <-serverDone; err != nil {
+		t.Fatalf("server failed: %v", err)
+	}
+	//the capture spans the upgrade
+	if !bytes.Equal(captured, []byte("STARTTLS"+DefaultReuqest)) {
+		t.Errorf("server captured %q", captured)
+	}
+}
+
+func TestBufferedReader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("first\nsecond\n"))
+	connection, _ := NewTcpConnection(server)
+	defer connection.Close()
+	connection.EnableSaveReadData()
+
+	line, err := connection.ReadSlice('\n')
+	if err != nil || string(line) != "first\n" {
+		t.Fatalf("ReadSlice returned %q, %v", line, err)
+	}
+	//the second line has been read ahead but not consumed
+	if n := connection.Buffered(); n != len("second\n") {
+		t.Errorf("%d bytes buffered, expected %d", n, len("second\n"))
+	}
+	if next, err := connection.Peek(6); err != nil || string(next) != "second" {
+		t.Errorf("Peek returned %q, %v", next, err)
+	}
+	if raw := string(connection.RawData()); raw != "first\n" {
+		t.Errorf("captured %q, expected only the consumed data", raw)
+	}
+	if n := connection.BytesRead(); n != int64(len("first\n")) {
+		t.Errorf("BytesRead returned %d", n)
+	}
+
+	connection.Reset()
+	buffer := make([]byte, 64)
+	n, err := connection.Read(buffer)
+	if err != nil || string(buffer[:n]) != "second\n" {
+		t.Errorf("Read returned %q, %v", buffer[:n], err)
+	}
+	if raw := string(connection.RawData()); raw != "second\n" {
+		t.Errorf("captured %q after Reset, expected %q", raw, "second\n")
+	}
+}
+
+func TestHttpPipelining(t *testing.T) {
+	srv := startTestServer(TestAddr3, NewHttpServerHandler(newTestLogger(), 1, "test_pipeline_srv"))
+	defer srv.Close()
+	connection, err := Connect(TestAddr3)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer connection.Close()
+
+	//both requests arrive in one read, so the second is read ahead of the first
+	request := "GET /1 HTTP/1.1\r\nConnection: keep-alive\r\n\r\nGET /2 HTTP/1.1\r\nConnection: keep-alive\r\n\r\n"
+	if _, err = connection.Write([]byte(request)); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	expected := DefaultOKResponse + DefaultOKResponse
+	received := make([]byte, 0, len(expected))
+	buffer := make([]byte, 1024)
+	for len(received) < len(expected) {
+		n, err := connection.Read(buffer)
+		if err != nil {
+			t.Fatalf("got %q, then %v", received, err)
+		}
+		received = append(received, buffer[:n]...)
+	}
+	if string(received) != expected {
+		t.Errorf("got %q, expected two responses", received)
+	}
+}
+
+func TestCaptureLimit(t *testing.T) {
+	for _, test := range []struct {
+		policy   CapturePolicy
+		captured string
+	}{
+		{CaptureDiscard, ""},
+		{CaptureHead, "0123"},
+		{CaptureTail, "789\n"},
+	} {
+		client, server := net.Pipe()
+		go client.Write([]byte("0123456789\nabc\n"))
+		connection, _ := NewTcpConnection(server)
+		connection.SetCaptureLimit(CaptureLimit{Bytes: 4, Policy: test.policy})
+		connection.EnableSaveReadData()
+
+		line, err := connection.ReadSlice('\n')
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !connection.CaptureOverflowed() {
+			t.Errorf("policy %d: %d bytes read without overflowing a limit of 4", test.policy, len(line))
+		}
+		if raw := string(connection.RawData()); raw != test.captured {
+			t.Errorf("policy %d: captured %q, expected %q", test.policy, raw, test.captured)
+		}
+
+		//the next message fits
+		connection.MarkRawDataBoundary()
+		connection.ReadSlice('\n')
+		if raw := string(connection.RawData()); raw != "abc\n" || connection.CaptureOverflowed() {
+			t.Errorf("policy %d: captured %q of the next message, overflowed: %v", test.policy, raw, connection.CaptureOverflowed())
+		}
+		client.Close()
+		connection.Close()
+	}
+}
+
+func TestHttpClientCaptureLimit(t *testing.T) {
+	srv := startTestServer(TestAddr3, NewHttpServerHandler(newTestLogger(), 2, "test_capture_srv"))
+	defer srv.Close()
+	pool := NewPool()
+	pool.SaveReadData = true
+	pool.CaptureLimit = CaptureLimit{Bytes: 16, Policy: CaptureDiscard}
+	defer pool.Close()
+
+	uHttpRequest := &UpstreamHttpRequest{Request: []byte("GET / HTTP/1.1\r\n\r\n")}
+	httpRequest, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(uHttpRequest.Request)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	uHttpRequest.HttpRequest = httpRequest
+	response, err := pool.SendAndReceive(context.Background(), TestAddr3, nil, &HttpClientHandler{}, uHttpRequest)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	//the response is rebuilt from the parsed one
+	if body := string(response.(*UpstreamHttpResponse).Body); !strings.HasSuffix(DefaultOKResponse, "\r\n\r\n"+body) {
+		t.Errorf("got body %q of %q", body, DefaultOKResponse)
+	}
+}
+
+func TestWrittenDataAndTee(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	connection, _ := NewTcpConnection(server)
+	defer connection.Close()
+	connection.EnableSaveWrittenData()
+	traffic := &bytes.Buffer{}
+	connection.SetTee(traffic)
+
+	go func() {
+		buffer := make([]byte, 16)
+		n, _ := client.Read(buffer)
+		client.Write(bytes.ToUpper(buffer[:n]))
+	}()
+	start := time.Now()
+	if _, err := connection.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buffer := make([]byte, 16)
+	n, err := connection.Read(buffer)
+	if err != nil || string(buffer[:n]) != "HELLO" {
+		t.Fatalf("Read returned %q, %v", buffer[:n], err)
+	}
+	if written := string(connection.WrittenData()); written != "hello" {
+		t.Errorf("WrittenData returned %q", written)
+	}
+
+	var frames []*TeeFrame
+	for {
+		frame, err := ReadTeeFrame(traffic)
+		if err != nil {
+			if err != io.EOF {
+				t.Errorf("failed to read a frame: %v", err)
+			}
+			break
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) != 2 || frames[0].Direction != TeeWrite || string(frames[0].Data) != "hello" ||
+		frames[1].Direction != TeeRead || string(frames[1].Data) != "HELLO" {
+		t.Fatalf("got frames %+v", frames)
+	}
+	if frames[0].Time.Before(start) || frames[1].Time.Before(frames[0].Time) {
+		t.Errorf("frame times %v and %v out of order", frames[0].Time, frames[1].Time)
+	}
+
+	connection.MarkRawDataBoundary()
+	if written := connection.WrittenData(); len(written) != 0 {
+		t.Errorf("WrittenData returned %q after a boundary", written)
+	}
+}
+
+func TestConnectionStats(t *testing.T) {
+	address := TestAddr4
+	serverConfig, clientConfig, err := GenerateTestTLS("localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certificates: %v", err)
+	}
+	srv := NewServer(&EchoServerHandler{})
+	if err = srv.StartTLSConfig(address, serverConfig); err != nil {
+		t.Fatalf("failed to listen on %s: %v", address, err)
+	}
+	defer srv.Close()
+
+	start := time.Now()
+	connection, err := ConnectTLSConfig(address, clientConfig)
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", address, err)
+	}
+	data := DataStream("")
+	if _, err = SendAndReceive(connection, NewEchoClientHandler(), &data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stats := connection.Stats()
+	connection.Close()
+	if stats.BytesWritten != int64(len(DefaultReuqest)) || stats.BytesRead != int64(len(DefaultResponse)) ||
+		stats.Writes != 1 || stats.Requests != 1 {
+		t.Errorf("got client stats %+v", stats)
+	}
+	//the connection opened when dialing started
+	if stats.ConnectTime <= 0 || stats.TLSHandshake <= 0 || stats.Opened.Before(start) ||
+		stats.FirstByte.Before(stats.Opened.Add(stats.ConnectTime+stats.TLSHandshake)) ||
+		stats.LastActivity.Before(stats.FirstByte) {
+		t.Errorf("got client times %+v", stats)
+	}
+
+	//the server closes its side once it sees the client has
+	deadline := time.Now().Add(2 * time.Second)
+	total := srv.Stats()
+	for total.Open > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		total = srv.Stats()
+	}
+	if total.Connections != 1 || total.Open != 0 || total.Requests != 1 || total.TLSHandshake <= 0 ||
+		total.BytesRead != stats.BytesWritten || total.BytesWritten != stats.BytesRead {
+		t.Errorf("got server stats %+v", total)
+	}
+}
+
+func TestConnectionLiteralStats(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	//a TcpConnection made without NewTcpConnection still works and counts
+	connection := &TcpConnection{Conn: client}
+	defer connection.Close()
+	go func() {
+		buffer := make([]byte, 16)
+		n, _ := server.Read(buffer)
+		server.Write(buffer[:n])
+	}()
+	data := DataStream("")
+	if response, err := SendAndReceive(connection, NewEchoClientHandler(), &data); err != nil || responseString(response) != DefaultReuqest {
+		t.Fatalf("got %q, %v", responseString(response), err)
+	}
+	stats := connection.Stats()
+	if stats.Requests != 1 || stats.BytesWritten != int64(len(DefaultReuqest)) || stats.BytesRead != int64(len(DefaultReuqest)) || stats.Opened.IsZero() {
+		t.Errorf("got stats %+v", stats)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copy the traffic of a connection, in both directions, to a writer.
+ */
+
+package ptcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+//TeeDirection tells which way the data of a TeeFrame went
+type TeeDirection byte
+
+const (
+	TeeRead  TeeDirection = 'R' //received from the peer
+	TeeWrite TeeDirection = 'W' //sent to the peer
+)
+
+//teeHeaderLength is the size of the frame header: direction, time and length
+const teeHeaderLength = 1 + 8 + 4
+
+var ErrorInvalidTeeFrame = errors.New("Invalid tee frame")
+
+/*
+ * TeeFrame is the data of one Read from the socket or one Write to it. On the
+ * writer given to SetTee each frame is a header of the direction byte, the
+ * time in nanoseconds since the Unix epoch (8 bytes) and the length of the
+ * data (4 bytes), both big endian, followed by the data.
+ */
+type TeeFrame struct {
+	Direction TeeDirection
+	Time      time.Time
+	Data      []byte
+}
+
+//WriteTo writes the frame in the tee format
+func (frame *TeeFrame) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, teeHeaderLength)
+	header[0] = byte(frame.Direction)
+	binary.BigEndian.PutUint64(header[1:], uint64(frame.Time.UnixNano()))
+	binary.BigEndian.PutUint32(header[9:], uint32(len(frame.Data)))
+	n, err := w.Write(append(header, frame.Data...))
+	return int64(n), err
+}
+
+//ReadTeeFrame reads the next frame written by a tee; it returns io.EOF after the last one
+func ReadTeeFrame(r io.Reader) (*TeeFrame, error) {
+	header := make([]byte, teeHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	direction := TeeDirection(header[0])
+	if direction != TeeRead && direction != TeeWrite {
+		return nil, ErrorInvalidTeeFrame
+	}
+	frame := &TeeFrame{
+		Direction: direction,
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:]))),
+		Data:      make([]byte, binary.BigEndian.Uint32(header[9:])),
+	}
+	if _, err := io.ReadFull(r, frame.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+//tee writes frames for a connection; reads and writes may come from different goroutines
+type tee struct {
+	mutex sync.Mutex
+	w     io.Writer
+	err   error //the first write error; nothing is written after it
+}
+
+func (t *tee) write(direction TeeDirection, data []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.err != nil {
+		return
+	}
+	frame := &TeeFrame{Direction: direction, Time: time.Now(), Data: data}
+	_, t.err = frame.WriteTo(t.w)
+}
+
+//SetTee copies every Read from and Write to the socket to w as a TeeFrame, from now on.
+//A failure to write to w does not affect the connection, but ends the copy, see TeeError.
+//A nil w stops the copy.
+func (connection *TcpConnection) SetTee(w io.Writer) {
+	if w == nil {
+		connection.tee = nil
+		return
+	}
+	connection.tee = &tee{w: w}
+}
+
+//TeeError returns the error that ended the copy set up by SetTee, if any
+func (connection *TcpConnection) TeeError() error {
+	if connection.tee == nil {
+		return nil
+	}
+	connection.tee.mutex.Lock()
+	defer connection.tee.mutex.Unlock()
+	return connection.tee.err
+}
@@ -0,0 +1,88 @@
+/*
+ * Helpers to build TLS configurations from PEM files.
+ */
+
+package ptcp
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"time"
+)
+
+var ErrorNoCertificates = errors.New("No certificates found in PEM data")
+
+//LoadCertPool reads a pool of CA certificates from one or more PEM bundles
+func LoadCertPool(caFiles ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, caFile := range caFiles {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrorNoCertificates
+		}
+	}
+	return pool, nil
+}
+
+//ClientTLSConfig builds a config for ConnectTLSConfig.
+//serverName is used for SNI and verification, and defaults to the host being dialed.
+//caFile replaces the system roots when not empty, and the certFile/keyFile pair,
+//when not empty, is presented to servers that ask for a client certificate.
+//Versions and cipher suites can be set on the returned config.
+func ClientTLSConfig(serverName string, caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+//ServerTLSConfig builds the config ListenAndServeTLS uses for the certFile/keyFile pair
+func ServerTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		Rand:       rand.Reader,
+		Time:       time.Now,
+		NextProtos: []string{"http/1.1"},
+	}
+
+	var err error
+	config.Certificates = make([]tls.Certificate, 1)
+	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+//SetClientAuth makes a server config ask for client certificates.
+//clientAuth is one of the tls.ClientAuthType policies, e.g. tls.RequireAndVerifyClientCert
+//for mutual TLS or tls.VerifyClientCertIfGiven to make them optional.
+//Certificates are verified against the CAs in caFiles.
+func SetClientAuth(config *tls.Config, clientAuth tls.ClientAuthType, caFiles ...string) error {
+	if len(caFiles) > 0 {
+		pool, err := LoadCertPool(caFiles...)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = pool
+	}
+	config.ClientAuth = clientAuth
+	return nil
+}
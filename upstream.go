@@ -0,0 +1,235 @@
+/*
+ * Spread requests over several instances of an upstream server.
+ */
+
+package ptcp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//BalancePolicy decides which backend of an Upstream serves a request
+type BalancePolicy int
+
+const (
+	RoundRobin       BalancePolicy = iota //each backend in turn
+	LeastOutstanding                      //the backend with the fewest requests in progress
+	ConsistentHash                        //the backend the key of a KeyedRequest hashes to
+)
+
+const (
+	DefaultMaxFails     = 3
+	DefaultEjectTimeout = 10 * time.Second
+	//points per backend on the consistent hash ring
+	hashRingReplicas = 100
+)
+
+var ErrorNoBackend = errors.New("No upstream backend available")
+
+//KeyedRequest is implemented by requests that carry the key ConsistentHash balances on,
+//e.g. a session or user id. Requests without one are sent round-robin.
+type KeyedRequest interface {
+	BalanceKey() string
+}
+
+type backend struct {
+	addr         string
+	outstanding  int       //requests in progress
+	fails        int       //consecutive failures
+	ejectedUntil time.Time //not used before then
+	unhealthy    bool      //failed its last health check
+	lastCheck    time.Time
+	checkErr     error //of the last health check
+}
+
+type hashPoint struct {
+	hash    uint32
+	backend int
+}
+
+/*
+ * Upstream sends requests to a group of backends through a Pool. A backend
+ * that fails MaxFails requests in a row is ejected for EjectTimeout, after
+ * which it is tried again. Errors caused by the caller's context do not count
+ * as failures.
+ */
+type Upstream struct {
+	Policy BalancePolicy
+	//MaxFails consecutive failures eject a backend; zero means DefaultMaxFails
+	MaxFails int
+	//EjectTimeout is how long an ejected backend is left out; zero means DefaultEjectTimeout
+	EjectTimeout time.Duration
+	//TLSConfig is used for the connections to the backends; nil for plain connections
+	TLSConfig *tls.Config
+
+	pool     *Pool
+	mutex    sync.Mutex
+	backends []*backend
+	next     int         //round-robin position
+	ring     []hashPoint //sorted by hash
+}
+
+//NewUpstream balances over addrs, taking connections from pool; a new Pool is used if it is nil
+func NewUpstream(pool *Pool, addrs ...string) *Upstream {
+	if pool == nil {
+		pool = NewPool()
+	}
+	u := &Upstream{pool: pool}
+	for i, addr := range addrs {
+		u.backends = append(u.backends, &backend{addr: addr})
+		for r := 0; r < hashRingReplicas; r++ {
+			hash := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(r)))
+			u.ring = append(u.ring, hashPoint{hash: hash, backend: i})
+		}
+	}
+	sort.Slice(u.ring, func(i, j int) bool { return u.ring[i].hash < u.ring[j].hash })
+	return u
+}
+
+//Pool returns the pool the upstream takes its connections from
+func (u *Upstream) Pool() *Pool {
+	return u.pool
+}
+
+func (u *Upstream) maxFails() int {
+	if u.MaxFails > 0 {
+		return u.MaxFails
+	}
+	return DefaultMaxFails
+}
+
+func (u *Upstream) ejectTimeout() time.Duration {
+	if u.EjectTimeout > 0 {
+		return u.EjectTimeout
+	}
+	return DefaultEjectTimeout
+}
+
+func (b *backend) usable(now time.Time) bool {
+	return !b.unhealthy && !now.Before(b.ejectedUntil)
+}
+
+//must hold the mutex
+func (u *Upstream) pickRoundRobin(now time.Time) *backend {
+	for i := 0; i < len(u.backends); i++ {
+		b := u.backends[(u.next+i)%len(u.backends)]
+		if b.usable(now) {
+			u.next = (u.next + i + 1) % len(u.backends)
+			return b
+		}
+	}
+	return nil
+}
+
+//must hold the mutex
+func (u *Upstream) pickLeastOutstanding(now time.Time) *backend {
+	var best *backend
+	//start at the round-robin position so that ties are spread
+	for i := 0; i < len(u.backends); i++ {
+		b := u.backends[(u.next+i)%len(u.backends)]
+		if b.usable(now) && (best == nil || b.outstanding < best.outstanding) {
+			best = b
+		}
+	}
+	u.next = (u.next + 1) % len(u.backends)
+	return best
+}
+
+//must hold the mutex
+func (u *Upstream) pickHash(key string, now time.Time) *backend {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(u.ring), func(i int) bool { return u.ring[i].hash >= hash })
+	//walk clockwise past ejected backends, so that only their keys move
+	for i := 0; i < len(u.ring); i++ {
+		b := u.backends[u.ring[(start+i)%len(u.ring)].backend]
+		if b.usable(now) {
+			return b
+		}
+	}
+	return nil
+}
+
+//must hold the mutex
+func (u *Upstream) pick(request Request) *backend {
+	if len(u.backends) == 0 {
+		return nil
+	}
+	now := time.Now()
+	switch u.Policy {
+	case LeastOutstanding:
+		return u.pickLeastOutstanding(now)
+	case ConsistentHash:
+		if keyed, ok := request.(KeyedRequest); ok {
+			return u.pickHash(keyed.BalanceKey(), now)
+		}
+	}
+	return u.pickRoundRobin(now)
+}
+
+//Pick returns the address the request would be sent to
+func (u *Upstream) Pick(request Request) (string, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	b := u.pick(request)
+	if b == nil {
+		return "", ErrorNoBackend
+	}
+	return b.addr, nil
+}
+
+//Available returns the addresses of the backends that are neither ejected nor unhealthy
+func (u *Upstream) Available() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	now := time.Now()
+	var addrs []string
+	for _, b := range u.backends {
+		if b.usable(now) {
+			addrs = append(addrs, b.addr)
+		}
+	}
+	return addrs
+}
+
+//record the outcome of a request to b
+func (u *Upstream) done(b *backend, failed bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	b.outstanding--
+	if !failed {
+		b.fails = 0
+		return
+	}
+	b.fails++
+	if b.fails >= u.maxFails() {
+		b.fails = 0
+		b.ejectedUntil = time.Now().Add(u.ejectTimeout())
+	}
+}
+
+//SendAndReceive sends the request to a backend chosen by the Policy,
+//see Pool.SendAndReceive
+func (u *Upstream) SendAndReceive(ctx context.Context, handler ClientHandler, request Request) (Response, error) {
+	if handler == nil {
+		return nil, ErrorMissingClientHandler
+	}
+	u.mutex.Lock()
+	b := u.pick(request)
+	if b != nil {
+		b.outstanding++
+	}
+	u.mutex.Unlock()
+	if b == nil {
+		return nil, ErrorNoBackend
+	}
+	response, err := u.pool.SendAndReceive(ctx, b.addr, u.TLSConfig, handler, request)
+	u.done(b, err != nil && ctx.Err() == nil)
+	return response, err
+}
@@ -0,0 +1,126 @@
+package ptcp
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const TestAddr5 = "localhost:13256"
+
+//nothing listens on TestDeadAddr
+const TestDeadAddr = "localhost:13259"
+
+type keyedRequest struct {
+	DataStream
+	key string
+}
+
+func (r *keyedRequest) BalanceKey() string {
+	return r.key
+}
+
+//start a server on addr that replies with addr
+func startNamedServer(addr string) *Server {
+	return startTestServer(addr, &ReplyHandler{reply: func(*TcpConnection) string { return addr }})
+}
+
+func sendToUpstream(u *Upstream, request Request) (string, error) {
+	response, err := u.SendAndReceive(context.Background(), &StrictEchoClientHandler{NewEchoClientHandler()}, request)
+	return responseString(response), err
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	srv3 := startNamedServer(TestAddr3)
+	defer srv3.Close()
+	srv5 := startNamedServer(TestAddr5)
+	defer srv5.Close()
+	u := NewUpstream(nil, TestAddr3, TestAddr5)
+	defer u.Pool().Close()
+
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		data := DataStream("")
+		reply, err := sendToUpstream(u, &data)
+		if err != nil {
+			t.Fatalf("exchange %d failed: %v", i, err)
+		}
+		counts[reply]++
+	}
+	if counts[TestAddr3] != 3 || counts[TestAddr5] != 3 {
+		t.Errorf("requests were spread as %v, expected 3 each", counts)
+	}
+}
+
+func TestUpstreamEjection(t *testing.T) {
+	srv := startNamedServer(TestAddr3)
+	defer srv.Close()
+	u := NewUpstream(nil, TestDeadAddr, TestAddr3)
+	u.MaxFails = 2
+	u.EjectTimeout = 100 * time.Millisecond
+	defer u.Pool().Close()
+
+	failures := 0
+	for i := 0; i < 6; i++ {
+		data := DataStream("")
+		if reply, err := sendToUpstream(u, &data); err != nil {
+			failures++
+		} else if reply != TestAddr3 {
+			t.Errorf("got reply %q", reply)
+		}
+	}
+	if failures != 2 {
+		t.Errorf("%d requests failed, expected MaxFails before the backend was ejected", failures)
+	}
+	if available := u.Available(); len(available) != 1 || available[0] != TestAddr3 {
+		t.Errorf("available backends %v, expected %s only", available, TestAddr3)
+	}
+	time.Sleep(u.EjectTimeout)
+	if available := u.Available(); len(available) != 2 {
+		t.Errorf("available backends %v after the cooldown, expected both", available)
+	}
+}
+
+func TestUpstreamLeastOutstanding(t *testing.T) {
+	u := NewUpstream(nil, TestAddr3, TestAddr5)
+	u.Policy = LeastOutstanding
+	u.backends[0].outstanding = 2
+	data := DataStream("")
+	for i := 0; i < 3; i++ {
+		if addr, err := u.Pick(&data); err != nil || addr != TestAddr5 {
+			t.Errorf("picked %s, %v; expected the idle backend %s", addr, err, TestAddr5)
+		}
+	}
+}
+
+func TestUpstreamConsistentHash(t *testing.T) {
+	addrs := []string{TestAddr, TestAddr2, TestAddr3, TestAddr5}
+	u := NewUpstream(nil, addrs...)
+	u.Policy = ConsistentHash
+
+	picked := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := "user" + strconv.Itoa(i)
+		addr, err := u.Pick(&keyedRequest{key: key})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if again, _ := u.Pick(&keyedRequest{key: key}); again != addr {
+			t.Fatalf("key %s went to %s and then %s", key, addr, again)
+		}
+		picked[key] = addr
+	}
+
+	//ejecting a backend only moves its own keys
+	u.backends[0].ejectedUntil = time.Now().Add(time.Hour)
+	for key, addr := range picked {
+		moved, _ := u.Pick(&keyedRequest{key: key})
+		if addr == addrs[0] && moved == addrs[0] {
+			t.Errorf("key %s still goes to the ejected backend", key)
+		}
+		if addr != addrs[0] && moved != addr {
+			t.Errorf("key %s moved from %s to %s", key, addr, moved)
+		}
+	}
+}